@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// regenerateBatchSize is how many album IDs are fetched per page while
+// scanning for stale thumbnails
+const regenerateBatchSize = 100
+
+// requireAdminKey rejects requests that don't carry the configured admin API
+// key in X-API-Key. With no key configured every request is rejected.
+func requireAdminKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validAdminKey(c.GetHeader("X-API-Key")) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing API key"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireDebugOrAdmin lets a request through when debug endpoints are
+// enabled or it carries the admin API key. Otherwise the route answers 404,
+// as the other debug routes do when disabled.
+func requireDebugOrAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !cfg.DebugEndpoints && !validAdminKey(c.GetHeader("X-API-Key")) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// validAdminKey reports whether key is the configured admin API key
+func validAdminKey(key string) bool {
+	return cfg.AdminAPIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.AdminAPIKey)) == 1
+}
+
+// RegenerateThumbnails rebuilds every thumbnail that was produced with
+// settings other than the current ones. Up-to-date rows are skipped, so an
+// interrupted run can simply be repeated.
+func regenerateThumbnails(c *gin.Context) {
+	spec := thumbnailSpec()
+
+	var processed, skipped, failed atomic.Int64
+	jobs := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.ThumbnailWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				updated, err := regenerateThumbnail(c.Request.Context(), id, spec)
+				if err != nil {
+					log.Printf("Failed to regenerate thumbnail for album %d: %v", id, err)
+					failed.Add(1)
+					continue
+				}
+				if !updated {
+					skipped.Add(1)
+					continue
+				}
+				processed.Add(1)
+			}
+		}()
+	}
+
+	// Page through stale rows by ID so each is visited at most once
+	var lastID int64
+	var scanErr error
+	for scanErr == nil {
+		var ids []int64
+		ids, scanErr = staleThumbnailIDs(c.Request.Context(), lastID, spec)
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			jobs <- id
+		}
+		lastID = ids[len(ids)-1]
+	}
+	close(jobs)
+	wg.Wait()
+
+	summary := gin.H{"spec": spec, "processed": processed.Load(), "skipped": skipped.Load(), "failed": failed.Load()}
+	if scanErr != nil {
+		log.Printf("Thumbnail regeneration stopped after album %d: %v", lastID, scanErr)
+		summary["error"] = "Database error while scanning albums"
+		c.JSON(http.StatusInternalServerError, summary)
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// staleThumbnailIDs returns the next page of album IDs after lastID whose
+// thumbnail doesn't match spec
+func staleThumbnailIDs(ctx context.Context, lastID int64, spec string) ([]int64, error) {
+	query := `SELECT id FROM Albums
+		WHERE id > ? AND (thumbnail_spec IS NULL OR thumbnail_spec <> ?)
+		ORDER BY id LIMIT ?`
+	rows, err := readQuery(ctx, query, lastID, spec, regenerateBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// regenerateThumbnail rebuilds one album's thumbnail with the current
+// settings. It reports false without writing when the image was replaced
+// while the thumbnail was being made, since the replacement brought its own.
+func regenerateThumbnail(ctx context.Context, albumID int64, spec string) (bool, error) {
+	var image []byte
+	var hash string
+	err := readQueryRow(ctx, "SELECT image, image_hash FROM Albums WHERE id = ?", albumID).Scan(&image, &hash)
+	if err != nil {
+		return false, err
+	}
+
+	thumb, err := makeThumbnail(image, cfg.ThumbnailWidth, cfg.ThumbnailQuality)
+	if err != nil {
+		return false, err
+	}
+
+	// Thumbnails aren't part of the listed metadata, so keep updated_at as is
+	query := `UPDATE Albums SET thumbnail = ?, thumbnail_spec = ?, updated_at = updated_at
+		WHERE id = ? AND image_hash = ?`
+	result, err := db.ExecContext(ctx, query, thumb, spec, albumID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// reindexBatchSize is how many rows each reindex transaction locks
+const reindexBatchSize = 500
+
+// Reindex recomputes artist_norm and title_norm for every album under the
+// current normalization rules. Each batch is its own short transaction that
+// locks only the rows it rewrites, so the table stays writable throughout.
+// Rows already up to date aren't touched, and ?after=ID resumes a run that
+// stopped partway, as reported in lastId.
+func reindexAlbums(c *gin.Context) {
+	lastID, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil || lastID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "after must be a non-negative album ID"})
+		return
+	}
+
+	var scanned, updated, batches int
+	for {
+		n, changed, next, err := reindexBatch(c.Request.Context(), lastID)
+		if err != nil {
+			log.Printf("Reindex stopped after album %d: %v", lastID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error while reindexing",
+				"scanned": scanned, "updated": updated, "batches": batches, "lastId": lastID})
+			return
+		}
+		if n == 0 {
+			break
+		}
+		scanned, updated, batches, lastID = scanned+n, updated+changed, batches+1, next
+		log.Printf("Reindex: %d rows scanned, %d updated, through album %d", scanned, updated, lastID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"scanned": scanned, "updated": updated, "batches": batches, "lastId": lastID})
+}
+
+// reindexBatch rewrites the stale normalized columns of the next batch of
+// albums after lastID, returning how many rows it scanned and changed and the
+// last ID it covered
+func reindexBatch(ctx context.Context, lastID int64) (scanned, updated int, next int64, err error) {
+	err = withTx(ctx, func(tx *sql.Tx) error {
+		scanned, updated, next = 0, 0, lastID
+		rows, err := tx.Query(`SELECT id, artist, title, artist_norm, title_norm FROM Albums
+			WHERE id > ? ORDER BY id LIMIT ? FOR UPDATE`, lastID, reindexBatchSize)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id                                 int64
+			artist, title, artistKey, titleKey string
+		}
+		var stale []row
+		for rows.Next() {
+			var r row
+			var artistNorm, titleNorm sql.NullString
+			if err := rows.Scan(&r.id, &r.artist, &r.title, &artistNorm, &titleNorm); err != nil {
+				rows.Close()
+				return err
+			}
+			scanned, next = scanned+1, r.id
+			r.artistKey, r.titleKey = matchKey(r.artist), matchKey(r.title)
+			if artistNorm.String != r.artistKey || titleNorm.String != r.titleKey || !artistNorm.Valid || !titleNorm.Valid {
+				stale = append(stale, r)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// The listed metadata is unchanged, so keep updated_at as is. New
+		// keys are a new identity, so the upsert claim moves with them.
+		for _, r := range stale {
+			_, err := tx.Exec(`UPDATE Albums SET upsert_canonical = NULL, artist_norm = ?, title_norm = ?,
+				updated_at = updated_at WHERE id = ?`, r.artistKey, r.titleKey, r.id)
+			if err != nil {
+				return err
+			}
+			if err := claimUpsertIdentity(tx, r.id); err != nil {
+				return err
+			}
+		}
+		updated = len(stale)
+		return nil
+	})
+	return scanned, updated, next, err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRegenerateThumbnailsSkipsReplacedImages(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		switch {
+		case queryIs(query, "SELECT id FROM Albums"):
+			if args[0].Value.(int64) == 0 {
+				return fakeResult{rows: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+			}
+			return fakeResult{}, nil
+		case queryIs(query, "SELECT image, image_hash"):
+			return fakeResult{rows: [][]driver.Value{{pngImage(t), "hash"}}}, nil
+		case queryIs(query, "UPDATE Albums SET thumbnail"):
+			// Album 2's image changes between the read and the write
+			if args[2].Value.(int64) == 2 {
+				return fakeResult{}, nil
+			}
+			return fakeResult{affected: 1}, nil
+		}
+		return fakeResult{}, nil
+	})
+
+	w := serve(func(r *gin.Engine) {
+		r.POST("/admin/thumbnails/regenerate", regenerateThumbnails)
+	}, httptest.NewRequest(http.MethodPost, "/admin/thumbnails/regenerate", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusOK, w.Body)
+	}
+	var summary struct{ Processed, Skipped, Failed int }
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Processed != 1 || summary.Skipped != 1 || summary.Failed != 0 {
+		t.Errorf("summary = %+v, want 1 processed and 1 skipped", summary)
+	}
+}
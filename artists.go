@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// artistMerge is the body of POST /artists/merge
+type artistMerge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// MergeArtists renames every album whose artist matches from, compared the
+// way the insert path normalizes names, to the cleaned form of to. All albums
+// move in one transaction, each with its own version bump and audit entry.
+// When both names share a match key only the stored spelling changes, which
+// makes this the way to fix an artist's capitalization too.
+func mergeArtists(c *gin.Context) {
+	var req artistMerge
+	if !decodeJSONBody(c, &req) {
+		return
+	}
+	from, to := cleanField(req.From), cleanField(req.To)
+	if from == "" || to == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to are required"})
+		return
+	}
+	if from == to {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must differ"})
+		return
+	}
+	if rejectDeniedArtist(c, to) {
+		return
+	}
+
+	actor := requestActor(c)
+	var moved []Album
+	err := withTx(c.Request.Context(), func(tx *sql.Tx) error {
+		moved = nil
+		query := "SELECT " + albumSummaryColumns + " FROM Albums WHERE artist_norm = ? ORDER BY id FOR UPDATE"
+		rows, err := tx.Query(query, matchKey(from))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var a Album
+			if err := rows.Scan(a.summaryDest()...); err != nil {
+				rows.Close()
+				return err
+			}
+			moved = append(moved, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Albums already under to's match key stay counted the same
+		if cfg.MaxAlbumsPerArtist > 0 && matchKey(from) != matchKey(to) {
+			count, err := countArtistAlbums(tx, to)
+			if err != nil {
+				return err
+			}
+			if count+len(moved) > cfg.MaxAlbumsPerArtist {
+				return errArtistQuota
+			}
+		}
+
+		for i := range moved {
+			a := &moved[i]
+			// As in writeAlbumUpdate, a changed identity moves the upsert claim
+			_, err := tx.Exec(`UPDATE Albums SET upsert_canonical = IF(artist_norm = ?, upsert_canonical, NULL),
+				artist = ?, artist_norm = ?, version = version + 1 WHERE id = ?`,
+				matchKey(to), to, matchKey(to), a.ID)
+			if err != nil {
+				return fmt.Errorf("update album %d: %w", a.ID, err)
+			}
+			if err := claimUpsertIdentity(tx, a.ID); err != nil {
+				return fmt.Errorf("update album %d: %w", a.ID, err)
+			}
+			a.Artist = to
+			a.Version++
+			details := gin.H{"artist": to, "mergedFrom": from, "version": a.Version}
+			if err := writeAudit(tx, a.ID, auditUpdate, actor, details); err != nil {
+				return fmt.Errorf("audit album %d: %w", a.ID, err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errArtistQuota) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Merging would exceed the limit of %d albums per artist", cfg.MaxAlbumsPerArtist)})
+		return
+	} else if err != nil {
+		respondTxError(c, err, "Failed to merge artists")
+		return
+	}
+
+	for i := range moved {
+		invalidateCard(moved[i].ID)
+		publishAlbumEvent(albumEvent{Type: auditUpdate, AlbumID: moved[i].ID, Album: &moved[i]})
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "updated": len(moved)})
+}
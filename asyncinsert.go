@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With ASYNC_INSERTS, createAlbum hands validated albums to asyncInserts and
+// answers 202 straight away. A single writer drains the queue into
+// multi-row INSERTs, flushing when a batch reaches ASYNC_INSERT_BATCH_SIZE
+// rows or ASYNC_INSERT_BATCH_BYTES of images, or when ASYNC_INSERT_FLUSH_MS
+// passes. A batch the database rejects is retried one album at a time, so
+// one bad row doesn't take the rest down with it. Albums still queued when
+// the process dies are lost, and those that fail on their own are only
+// logged, so the mode trades durability for throughput.
+var asyncInserts struct {
+	// mu guards closed, so a handler still running after a forced shutdown
+	// never sends on the closed queue
+	mu     sync.RWMutex
+	closed bool
+	queue  chan asyncInsert
+	done   sync.WaitGroup
+}
+
+// asyncInsert is a queued album and who asked for it
+type asyncInsert struct {
+	in    *albumInput
+	actor string
+}
+
+// startAsyncInserts creates the queue and starts its writer
+func startAsyncInserts() {
+	asyncInserts.queue = make(chan asyncInsert, cfg.AsyncInsertQueueSize)
+	asyncInserts.done.Add(1)
+	go func() {
+		defer asyncInserts.done.Done()
+		runAsyncInserts(asyncInserts.queue)
+	}()
+}
+
+// enqueueAlbum queues in for the writer, returning false when the queue is
+// full so the caller can shed load instead of blocking
+func enqueueAlbum(in *albumInput, actor string) bool {
+	asyncInserts.mu.RLock()
+	defer asyncInserts.mu.RUnlock()
+	if asyncInserts.closed {
+		return false
+	}
+	select {
+	case asyncInserts.queue <- asyncInsert{in: in, actor: actor}:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopAsyncInserts closes the queue and waits for the writer to flush what
+// is left in it
+func stopAsyncInserts() {
+	if asyncInserts.queue == nil {
+		return
+	}
+	asyncInserts.mu.Lock()
+	asyncInserts.closed = true
+	close(asyncInserts.queue)
+	asyncInserts.mu.Unlock()
+	asyncInserts.done.Wait()
+}
+
+// runAsyncInserts batches queued albums until queue is closed
+func runAsyncInserts(queue <-chan asyncInsert) {
+	var batch []asyncInsert
+	var batchBytes int
+	timer := time.NewTimer(cfg.AsyncInsertFlushInterval)
+	timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			insertAlbumBatch(batch)
+		}
+		batch, batchBytes = nil, 0
+		timer.Stop()
+	}
+
+	for {
+		select {
+		case item, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(cfg.AsyncInsertFlushInterval)
+			}
+			batch = append(batch, item)
+			batchBytes += len(item.in.image) + len(item.in.thumbnail)
+			if len(batch) >= cfg.AsyncInsertBatchSize || batchBytes >= cfg.AsyncInsertBatchBytes {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// insertAlbumBatch writes batch with one multi-row INSERT plus its audit
+// entries, falling back to insertAlbumsSingly when that fails. Albums over
+// the artist quota are dropped and logged.
+func insertAlbumBatch(batch []asyncInsert) {
+	var created []asyncInsert
+	var createdIDs []int64
+	err := withTx(context.Background(), func(tx *sql.Tx) error {
+		created = nil
+		// Quota checks can't see the rows queued ahead in the same batch, so
+		// count those per artist as well
+		accepted := make([]asyncInsert, 0, len(batch))
+		queued := make(map[string]int)
+		for _, item := range batch {
+			key := matchKey(item.in.artist)
+			if cfg.MaxAlbumsPerArtist > 0 {
+				count, err := countArtistAlbums(tx, item.in.artist)
+				if err != nil {
+					return err
+				}
+				if count+queued[key] >= cfg.MaxAlbumsPerArtist {
+					log.Printf("Dropping queued album %q: artist %q is at the album limit", item.in.title, item.in.artist)
+					continue
+				}
+			}
+			queued[key]++
+			accepted = append(accepted, item)
+		}
+		if len(accepted) == 0 {
+			return nil
+		}
+
+		const row = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		query := `INSERT INTO Albums (artist, title, year, year_text, artist_norm, title_norm, filename, image, image_hash,
+			image_phash, thumbnail, thumbnail_spec, track_count, duration_seconds, upc, isrc) VALUES ` +
+			strings.TrimSuffix(strings.Repeat(row+", ", len(accepted)), ", ")
+		args := make([]any, 0, 16*len(accepted))
+		for _, item := range accepted {
+			in := item.in
+			args = append(args, in.artist, in.title, in.year, in.yearText, matchKey(in.artist), matchKey(in.title),
+				in.filename, in.image, imageHash(in.image), in.phash, in.thumbnail, in.thumbnailSpec, in.trackCount,
+				in.durationSeconds, in.upc, in.isrc)
+		}
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+
+		// MySQL reports the first ID of a multi-row INSERT. InnoDB allocates
+		// the IDs of an insert with a known row count as one block, spaced
+		// auto_increment_increment apart.
+		firstID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		var step int64
+		if err := tx.QueryRow("SELECT @@auto_increment_increment").Scan(&step); err != nil {
+			return err
+		}
+		ids := make([]int64, len(accepted))
+		for i, item := range accepted {
+			ids[i] = firstID + int64(i)*step
+			if err := claimUpsertIdentity(tx, ids[i]); err != nil {
+				return err
+			}
+			if err := writeAudit(tx, ids[i], auditCreate, item.actor, item.in.auditDetails()); err != nil {
+				return err
+			}
+		}
+		created, createdIDs = accepted, ids
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to insert batch of %d queued albums, inserting them one at a time: %v", len(batch), err)
+		insertAlbumsSingly(batch)
+		return
+	}
+	for i, item := range created {
+		id := createdIDs[i]
+		publishAlbumEvent(albumEvent{Type: auditCreate, AlbumID: id, Album: item.in.summary(id)})
+	}
+}
+
+// insertAlbumsSingly writes each album of a failed batch in its own
+// transaction, logging the ones that fail again
+func insertAlbumsSingly(batch []asyncInsert) {
+	for _, item := range batch {
+		_, err := createAlbumRecord(context.Background(), item.in, item.actor)
+		if errors.Is(err, errArtistQuota) {
+			log.Printf("Dropping queued album %q: artist %q is at the album limit", item.in.title, item.in.artist)
+		} else if err != nil {
+			log.Printf("Failed to insert queued album %q: %v", item.in.title, err)
+		}
+	}
+}
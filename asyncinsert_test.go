@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql/driver"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// queuedAlbums builds an async insert batch with one album per title
+func queuedAlbums(titles ...string) []asyncInsert {
+	batch := make([]asyncInsert, len(titles))
+	for i, title := range titles {
+		batch[i] = asyncInsert{in: &albumInput{artist: "Artist", title: title, year: 1999, filename: "cover.png"},
+			actor: "test"}
+	}
+	return batch
+}
+
+func TestInsertAlbumBatchSpacesIDsByIncrement(t *testing.T) {
+	var audited []int64
+	useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		switch {
+		case queryIs(query, "INSERT INTO Albums"):
+			return fakeResult{lastID: 100, affected: 3}, nil
+		case queryIs(query, "SELECT @@auto_increment_increment"):
+			return fakeResult{rows: [][]driver.Value{{int64(2)}}}, nil
+		case queryIs(query, "INSERT INTO audit_log"):
+			audited = append(audited, args[0].Value.(int64))
+		}
+		return fakeResult{affected: 1}, nil
+	})
+
+	insertAlbumBatch(queuedAlbums("a", "b", "c"))
+
+	if want := []int64{100, 102, 104}; !slices.Equal(audited, want) {
+		t.Errorf("audited IDs %v, want %v", audited, want)
+	}
+}
+
+func TestInsertAlbumBatchFallsBackToSingleRows(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: errDuplicateKey, Message: "Duplicate entry for key 'idx_albums_upc'"}
+	var nextID int64 = 10
+	fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		switch {
+		case queryIs(query, "INSERT INTO Albums") && strings.Count(query, "(?") > 1:
+			return fakeResult{}, duplicate
+		case queryIs(query, "INSERT INTO Albums"):
+			if args[1].Value == "dup" {
+				return fakeResult{}, duplicate
+			}
+			nextID++
+			return fakeResult{lastID: nextID}, nil
+		}
+		return fakeResult{affected: 1}, nil
+	})
+
+	insertAlbumBatch(queuedAlbums("a", "dup", "c"))
+
+	var inserted, audited int
+	for _, stmt := range fdb.appliedStatements() {
+		switch {
+		case queryIs(stmt, "INSERT INTO Albums"):
+			inserted++
+		case queryIs(stmt, "INSERT INTO audit_log"):
+			audited++
+		}
+	}
+	if inserted != 2 || audited != 2 {
+		t.Errorf("stored %d albums and %d audit entries, want the 2 without a duplicate", inserted, audited)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions recorded in audit_log
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// auditEntry is one row of an album's history
+type auditEntry struct {
+	ID        int64           `json:"id"`
+	AlbumID   int64           `json:"albumId"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	Timestamp time.Time       `json:"timestamp"`
+	Details   json.RawMessage `json:"details,omitempty"`
+}
+
+// requestActor identifies who is making a request for the audit trail: the
+// admin API key when one was presented and is valid, otherwise the client IP
+func requestActor(c *gin.Context) string {
+	if validAdminKey(c.GetHeader("X-API-Key")) {
+		return "api-key:admin"
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// writeAudit records a write operation within the transaction performing it,
+// so the audit trail and the data can never disagree
+func writeAudit(tx *sql.Tx, albumID int64, action, actor string, details any) error {
+	var raw []byte
+	if details != nil {
+		var err error
+		if raw, err = json.Marshal(details); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("INSERT INTO audit_log (album_id, action, actor, details) VALUES (?, ?, ?, ?)",
+		albumID, action, actor, raw)
+	return err
+}
+
+// AlbumHistory lists an album's audit trail, oldest first. History outlives
+// the album, so it stays readable after a delete.
+func albumHistory(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	// Fetch one row past the cap to detect overflow
+	query := "SELECT id, album_id, action, actor, created_at, details FROM audit_log WHERE album_id = ? ORDER BY id LIMIT ?"
+	rows, err := readQuery(c.Request.Context(), query, albumID, cfg.MaxResultRows+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.AlbumID, &e.Action, &e.Actor, &e.Timestamp, &details); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		e.Details = details
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if len(entries) > cfg.MaxResultRows {
+		if !allowOversizedResult(c) {
+			return
+		}
+		entries = entries[:cfg.MaxResultRows]
+	}
+
+	// Albums created before auditing began have no history yet
+	if len(entries) == 0 {
+		var exists int
+		err := readQueryRow(c.Request.Context(), "SELECT 1 FROM Albums WHERE id = ?", albumID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
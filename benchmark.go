@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// benchmarkActor is recorded in the audit log for albums the self-test writes
+const benchmarkActor = "benchmark"
+
+// benchmarkStats collects per-operation latencies from the benchmark workers
+type benchmarkStats struct {
+	sync.Mutex
+	create, get, cycle []time.Duration
+	errors             int
+}
+
+// runBenchmark runs n create+get cycles against the configured database with
+// the given number of concurrent workers and prints latency percentiles and
+// throughput. The albums it creates are deleted again afterwards.
+func runBenchmark(n, concurrency int) error {
+	if n <= 0 || concurrency <= 0 {
+		return fmt.Errorf("benchmark cycles and concurrency must be positive")
+	}
+	cover, err := benchmarkImage()
+	if err != nil {
+		return fmt.Errorf("render benchmark image: %w", err)
+	}
+	log.Printf("Benchmark: %d create+get cycles, concurrency %d", n, concurrency)
+
+	var stats benchmarkStats
+	var created []int64
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				id, createTime, getTime, err := benchmarkCycle(i, cover)
+				stats.Lock()
+				if id != 0 {
+					created = append(created, id)
+				}
+				if err != nil {
+					stats.errors++
+					log.Printf("Benchmark cycle %d failed: %v", i, err)
+				} else {
+					stats.create = append(stats.create, createTime)
+					stats.get = append(stats.get, getTime)
+					stats.cycle = append(stats.cycle, createTime+getTime)
+				}
+				stats.Unlock()
+			}
+		}()
+	}
+	for i := range n {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("cycles: %d ok, %d failed in %v\n", len(stats.cycle), stats.errors, elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput: %.1f cycles/s\n", float64(len(stats.cycle))/elapsed.Seconds())
+	printLatencies("create", stats.create)
+	printLatencies("get", stats.get)
+	printLatencies("cycle", stats.cycle)
+
+	removeBenchmarkAlbums(created)
+	return nil
+}
+
+// benchmarkCycle creates one album the way POST /albums does and reads it
+// back the way GET /albums/:id does
+func benchmarkCycle(i int, cover []byte) (albumID int64, createTime, getTime time.Duration, err error) {
+	start := time.Now()
+	in, err := newAlbumInput("Benchmark Artist", fmt.Sprintf("Benchmark %d", i), 2000, "benchmark.png", cover)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	albumID, err = createAlbumRecord(context.Background(), in, benchmarkActor)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("create: %w", err)
+	}
+	createTime = time.Since(start)
+
+	start = time.Now()
+	var album Album
+	query := "SELECT " + albumSummaryColumns + ", image FROM Albums WHERE id = ?"
+	err = readQueryRow(context.Background(), query, albumID).Scan(append(album.summaryDest(), &album.Image)...)
+	if err != nil {
+		return albumID, createTime, 0, fmt.Errorf("get: %w", err)
+	}
+	return albumID, createTime, time.Since(start), nil
+}
+
+// benchmarkImage renders a small PNG cover, so every cycle exercises image
+// validation and thumbnailing like a real upload
+func benchmarkImage() ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	for y := range 400 {
+		for x := range 400 {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// printLatencies prints percentiles of the recorded samples
+func printLatencies(name string, samples []time.Duration) {
+	if len(samples) == 0 {
+		fmt.Printf("%-7s no samples\n", name+":")
+		return
+	}
+	slices.Sort(samples)
+	pct := func(p float64) time.Duration {
+		return samples[int(p*float64(len(samples)-1))].Round(time.Microsecond)
+	}
+	fmt.Printf("%-7s p50=%v p90=%v p99=%v max=%v\n", name+":", pct(0.5), pct(0.9), pct(0.99), samples[len(samples)-1])
+}
+
+// removeBenchmarkAlbums deletes the albums the benchmark created
+func removeBenchmarkAlbums(ids []int64) {
+	for _, id := range ids {
+		err := withTx(context.Background(), func(tx *sql.Tx) error {
+			_, err := deleteAlbumRows(tx, id)
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to remove benchmark album %d: %v", id, err)
+		}
+	}
+	log.Printf("Benchmark: removed %d albums", len(ids))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// albumBundleFormat identifies the single-album export format
+const albumBundleFormat = "album-bundle/v1"
+
+// albumBundle is a self-contained album: its metadata plus the exact image
+// bytes, base64 encoded by encoding/json
+type albumBundle struct {
+	Format          string  `json:"format"`
+	Artist          string  `json:"artist"`
+	Title           string  `json:"title"`
+	Year            int     `json:"year"`
+	YearText        *string `json:"yearText,omitempty"`
+	Filename        string  `json:"filename"`
+	TrackCount      *int    `json:"trackCount,omitempty"`
+	DurationSeconds *int    `json:"durationSeconds,omitempty"`
+	UPC             *string `json:"upc,omitempty"`
+	ISRC            *string `json:"isrc,omitempty"`
+	ContentType     string  `json:"contentType"`
+	Image           []byte  `json:"image"`
+}
+
+// ExportAlbum returns an album as a bundle that POST /albums/import accepts
+func exportAlbum(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	b := albumBundle{Format: albumBundleFormat}
+	query := `SELECT artist, title, year, year_text, filename, track_count, duration_seconds, upc, isrc, image
+		FROM Albums WHERE id = ?`
+	err = replicaQueryRow(c.Request.Context(), query, albumID).Scan(&b.Artist, &b.Title, &b.Year, &b.YearText,
+		&b.Filename, &b.TrackCount, &b.DurationSeconds, &b.UPC, &b.ISRC, &b.Image)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	b.ContentType = detectImageType(b.Image)
+
+	c.Header("Content-Disposition", `attachment; filename="album-`+strconv.FormatInt(albumID, 10)+`.json"`)
+	c.JSON(http.StatusOK, b)
+}
+
+// ImportAlbum creates an album from a bundle made by exportAlbum. The image
+// goes through the same validation as an upload.
+func importAlbum(c *gin.Context) {
+	var b albumBundle
+	if !decodeJSONBody(c, &b) {
+		return
+	}
+	if b.Format != albumBundleFormat {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be " + albumBundleFormat})
+		return
+	}
+	if len(b.Image) > cfg.MaxImageBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image exceeds maximum size"})
+		return
+	}
+	if detected := detectImageType(b.Image); b.ContentType != "" && b.ContentType != detected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image content (" + detected + ") does not match contentType"})
+		return
+	}
+
+	if rejectDeniedArtist(c, b.Artist) {
+		return
+	}
+
+	in, err := newAlbumInput(b.Artist, b.Title, b.Year, b.Filename, b.Image)
+	if err == nil {
+		err = in.setDetails(b.TrackCount, b.DurationSeconds)
+	}
+	if err == nil {
+		in.yearText, err = checkYearText(in.year, b.YearText)
+	}
+	if err == nil {
+		in.upc, in.isrc, err = normalizeAlbumCodes(b.UPC, b.ISRC)
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	albumID, err := createAlbumRecord(c.Request.Context(), in, requestActor(c))
+	if err != nil {
+		respondCreateError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"AlbumID": albumID})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAlbumBundleRoundTripKeepsCodesAndYearText(t *testing.T) {
+	var inserted []driver.NamedValue
+	useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		switch {
+		case queryIs(query, "SELECT artist, title, year, year_text"):
+			return fakeResult{rows: [][]driver.Value{{"Artist", "Title", int64(1990), "199X", "cover.png",
+				nil, nil, "036000291452", "USRC17607839", pngImage(t)}}}, nil
+		case queryIs(query, "INSERT INTO Albums"):
+			inserted = args
+			return fakeResult{lastID: 9}, nil
+		}
+		return fakeResult{affected: 1}, nil
+	})
+
+	exported := serve(func(r *gin.Engine) { r.GET("/albums/:id/export", exportAlbum) },
+		httptest.NewRequest(http.MethodGet, "/albums/3/export", nil))
+	if exported.Code != http.StatusOK {
+		t.Fatalf("export status = %d, want %d (body %s)", exported.Code, http.StatusOK, exported.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/albums/import", bytes.NewReader(exported.Body.Bytes()))
+	req.Header.Set("Content-Type", "application/json")
+	imported := serve(func(r *gin.Engine) { r.POST("/albums/import", importAlbum) }, req)
+	if imported.Code != http.StatusCreated {
+		t.Fatalf("import status = %d, want %d (body %s)", imported.Code, http.StatusCreated, imported.Body)
+	}
+
+	stored := map[string]bool{}
+	for _, arg := range inserted {
+		if s, ok := arg.Value.(string); ok {
+			stored[s] = true
+		}
+	}
+	for _, want := range []string{"199X", "036000291452", "USRC17607839"} {
+		if !stored[want] {
+			t.Errorf("import did not store %q: %v", want, inserted)
+		}
+	}
+}
+
+func TestImportAlbumRejectsMismatchedYearText(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+	body := `{"format":"` + albumBundleFormat + `","artist":"Artist","title":"Title","year":1985,` +
+		`"yearText":"199X","filename":"cover.png","image":"` + base64.StdEncoding.EncodeToString(pngImage(t)) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/albums/import", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := serve(func(r *gin.Engine) { r.POST("/albums/import", importAlbum) }, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusUnprocessableEntity, w.Body)
+	}
+}
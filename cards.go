@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Card layout: the cover fills a square and the text sits in a band below
+const (
+	cardSize    = 600
+	cardBand    = 110
+	cardPadding = 24
+)
+
+var (
+	cardBackground = color.RGBA{0x18, 0x18, 0x18, 0xFF}
+	cardTitleColor = color.White
+	cardTextColor  = color.RGBA{0xBB, 0xBB, 0xBB, 0xFF}
+)
+
+// cardCache holds rendered cards by album ID. Entries are dropped when the
+// album is updated or deleted.
+var cardCache *lruCache[int64, []byte]
+
+// cardFaces are the bundled Go fonts, parsed on first use
+var cardFaces = sync.OnceValues(func() (faces [2]font.Face, err error) {
+	for i, f := range []struct {
+		ttf  []byte
+		size float64
+	}{{gobold.TTF, 30}, {goregular.TTF, 20}} {
+		parsed, err := opentype.Parse(f.ttf)
+		if err != nil {
+			return faces, err
+		}
+		faces[i], err = opentype.NewFace(parsed, &opentype.FaceOptions{Size: f.size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return faces, err
+		}
+	}
+	return faces, nil
+})
+
+// invalidateCard drops the cached card of an album whose metadata changed
+func invalidateCard(albumID int64) {
+	cardCache.RemoveFunc(func(id int64) bool { return id == albumID })
+}
+
+// renderCard draws the cover, cropped to a square, above a band carrying
+// the title and "artist · year", and encodes the result as PNG
+func renderCard(cover []byte, artist, title string, year int) ([]byte, error) {
+	faces, err := cardFaces()
+	if err != nil {
+		return nil, fmt.Errorf("load fonts: %w", err)
+	}
+	src, format, err := decodeImage(cover)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, cardSize, cardSize+cardBand))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(cardBackground), image.Point{}, draw.Src)
+
+	// Crop the centre square of the cover and scale it down. Rotating and
+	// flipping map the centre square onto itself, so the EXIF orientation is
+	// applied to the small square rather than the full cover.
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(b.Min).Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+	square := image.NewNRGBA(image.Rect(0, 0, cardSize, cardSize))
+	draw.ApproxBiLinear.Scale(square, square.Bounds(), src, crop, draw.Src, nil)
+	upright := applyOrientation(square, imageOrientation(cover, format))
+	draw.Draw(dst, image.Rect(0, 0, cardSize, cardSize), upright, image.Point{}, draw.Over)
+
+	maxWidth := fixed.I(cardSize - 2*cardPadding)
+	drawCardText(dst, faces[0], cardTitleColor, fitText(faces[0], title, maxWidth), cardSize+46)
+	drawCardText(dst, faces[1], cardTextColor, fitText(faces[1], fmt.Sprintf("%s · %d", artist, year), maxWidth), cardSize+84)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, fmt.Errorf("encode card: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// drawCardText writes s with its baseline at y
+func drawCardText(dst draw.Image, face font.Face, c color.Color, s string, y int) {
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(c), Face: face, Dot: fixed.P(cardPadding, y)}
+	d.DrawString(s)
+}
+
+// fitText shortens s with an ellipsis until it fits in width
+func fitText(face font.Face, s string, width fixed.Int26_6) string {
+	if font.MeasureString(face, s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		if t := string(runes) + "…"; font.MeasureString(face, t) <= width {
+			return t
+		}
+	}
+	return ""
+}
+
+// GetAlbumCard serves a shareable PNG of the cover with its details overlaid
+func getAlbumCard(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+	if card, ok := cardCache.Get(albumID); ok {
+		c.Data(http.StatusOK, "image/png", card)
+		return
+	}
+
+	var artist, title string
+	var year int
+	var image []byte
+	err = replicaQueryRow(c.Request.Context(), "SELECT artist, title, year, image FROM Albums WHERE id = ?", albumID).
+		Scan(&artist, &title, &year, &image)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	card, err := renderCard(image, artist, title, year)
+	if err != nil {
+		log.Printf("Failed to render card for album %d: %v", albumID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render card"})
+		return
+	}
+	cardCache.Add(albumID, card)
+
+	c.Data(http.StatusOK, "image/png", card)
+}
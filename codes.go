@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isrcPattern matches an ISRC with its hyphens removed: country, registrant,
+// year of reference and designation code
+var isrcPattern = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{3}[0-9]{7}$`)
+
+// normalizeUPC strips spaces and hyphens from a UPC-A (12 digits) or EAN-13
+// barcode and verifies its check digit
+func normalizeUPC(code string) (string, error) {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(code)
+	if len(code) != 12 && len(code) != 13 {
+		return "", &validationError{"UPC must be 12 or 13 digits"}
+	}
+	sum := 0
+	for i := 0; i < len(code); i++ {
+		d := code[i]
+		if d < '0' || d > '9' {
+			return "", &validationError{"UPC must be 12 or 13 digits"}
+		}
+		// Weights alternate 3 and 1 counting left from the check digit
+		if (len(code)-1-i)%2 == 1 {
+			sum += 3 * int(d-'0')
+		} else {
+			sum += int(d - '0')
+		}
+	}
+	if sum%10 != 0 {
+		return "", &validationError{"UPC check digit is invalid"}
+	}
+	return code, nil
+}
+
+// normalizeISRC uppercases an ISRC and strips its hyphens
+func normalizeISRC(code string) (string, error) {
+	code = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if !isrcPattern.MatchString(code) {
+		return "", &validationError{"ISRC must look like CC-XXX-YY-NNNNN"}
+	}
+	return code, nil
+}
+
+// normalizeAlbumCodes validates optional codes, returning them normalized.
+// Blank codes are treated as absent.
+func normalizeAlbumCodes(upc, isrc *string) (*string, *string, error) {
+	normalize := func(code *string, fn func(string) (string, error)) (*string, error) {
+		if code == nil || strings.TrimSpace(*code) == "" {
+			return nil, nil
+		}
+		n, err := fn(strings.TrimSpace(*code))
+		return &n, err
+	}
+	upc, err := normalize(upc, normalizeUPC)
+	if err != nil {
+		return nil, nil, err
+	}
+	isrc, err = normalize(isrc, normalizeISRC)
+	if err != nil {
+		return nil, nil, err
+	}
+	return upc, isrc, nil
+}
+
+// setCodes validates and attaches the optional codes from form values
+func (in *albumInput) setCodes(upc, isrc string) error {
+	var err error
+	in.upc, in.isrc, err = normalizeAlbumCodes(&upc, &isrc)
+	return err
+}
+
+// AlbumByUPC looks an album up by its barcode, in any accepted spelling
+func albumByUPC(c *gin.Context) {
+	upc, err := normalizeUPC(c.Param("upc"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var album Album
+	query := "SELECT " + albumSummaryColumns + " FROM Albums WHERE upc = ?"
+	err = replicaQueryRow(c.Request.Context(), query, upc).Scan(album.summaryDest()...)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.Header("ETag", strconv.Quote(strconv.Itoa(album.Version)))
+	c.JSON(http.StatusOK, album)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+)
+
+// config holds the settings resolved from the environment at startup
+type config struct {
+	// HTTP
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSAllowCredentials bool
+	TrustedProxies       []string
+	MaxRequestBytes      int64
+	DebugEndpoints       bool
+	StrictJSON           bool
+	ShutdownTimeout      time.Duration
+	StorageStatsTTL      time.Duration
+	Features             map[string]bool
+
+	// Logging
+	DebugLogging         bool
+	LogSampleRate        float64
+	SlowRequestThreshold time.Duration
+	SlowUploadThreshold  time.Duration
+	ErrorBufferSize      int
+
+	// Database
+	DBDriver           string
+	DBAutoCreate       bool
+	ConnMaxLifetime    time.Duration
+	ConnLifetimeJitter float64
+	TxRetries          int
+	TxRetryBackoff     time.Duration
+	RetryBudgetRate    float64
+	RetryBudgetBurst   int
+	DBMaxWaiters       int
+	DBWarmupConns      int
+	DBMaxExecutionTime time.Duration
+	MaxReplicaLag      time.Duration
+	ReplicaLagCritical bool
+
+	// Asynchronous inserts
+	AsyncInserts             bool
+	AsyncInsertQueueSize     int
+	AsyncInsertBatchSize     int
+	AsyncInsertBatchBytes    int
+	AsyncInsertFlushInterval time.Duration
+
+	// Admin
+	AdminAPIKey string
+
+	// Listing
+	DefaultPageSize        int
+	MaxPageSize            int
+	SimilarAlbumsLimit     int
+	SpriteMaxIDs           int
+	MaxResultRows          int
+	RejectOversizedResults bool
+	EmptySearchNotFound    bool
+	ViewFlushInterval      time.Duration
+
+	// Quotas
+	MaxAlbumsPerArtist            int
+	MaxConcurrentUploadsPerClient int
+	RateLimits                    map[string]rateLimit
+	GlobalRateLimit               rateLimit
+
+	// Normalization
+	NormalizeTitleCase bool
+
+	// Moderation
+	ArtistDenylist artistDenylist
+
+	// Uploads and images
+	FieldAliases       map[string][]string
+	DedupCreates       bool
+	DedupWindow        time.Duration
+	AllowedImageTypes  map[string]bool
+	MaxImageBytes      int
+	LargeImages        bool
+	MaxImagePixels     int64
+	VerifyImageDecode  bool
+	RecompressAbove    int
+	RecompressFloor    int
+	AllowFuzzyYear     bool
+	MaxFormParts       int
+	UploadDir          string
+	SpoolUploads       bool
+	SpoolDir           string
+	UploadTTL          time.Duration
+	ThumbnailWidth     int
+	ThumbnailQuality   int
+	ThumbnailMaxWidth  int
+	ThumbnailCacheSize int
+	ConvertedCacheSize int
+	CardCacheSize      int
+	ThumbnailWorkers   int
+
+	// Direct uploads to S3
+	S3Bucket           string
+	S3Region           string
+	S3Endpoint         string
+	S3UploadPrefix     string
+	S3UploadURLTTL     time.Duration
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+}
+
+// Global configuration, populated by loadConfig
+var cfg config
+
+func loadConfig() {
+	cfg.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS", nil)
+	cfg.CORSAllowedMethods = envList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE"})
+	cfg.CORSAllowedHeaders = envList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Content-Range", "If-Match", "X-HTTP-Method-Override"})
+	cfg.CORSAllowCredentials = envBool("CORS_ALLOW_CREDENTIALS", false)
+	cfg.TrustedProxies = envList("TRUSTED_PROXIES", nil)
+	cfg.MaxRequestBytes = int64(envInt("MAX_REQUEST_BYTES", 16<<20))
+	cfg.DebugEndpoints = envBool("DEBUG_ENDPOINTS", false)
+	cfg.StrictJSON = envBool("STRICT_JSON", false)
+	cfg.ShutdownTimeout = time.Duration(envInt("SHUTDOWN_TIMEOUT_SECONDS", 10)) * time.Second
+	cfg.StorageStatsTTL = time.Duration(envInt("STORAGE_STATS_TTL_SECONDS", 300)) * time.Second
+	cfg.Features = loadFeatures()
+
+	cfg.DebugLogging = strings.EqualFold(envString("LOG_LEVEL", "info"), "debug")
+	cfg.LogSampleRate = envFloat("LOG_SAMPLE_RATE", 1)
+	cfg.SlowRequestThreshold = time.Duration(envInt("SLOW_REQUEST_MS", 1000)) * time.Millisecond
+	cfg.SlowUploadThreshold = time.Duration(envInt("SLOW_UPLOAD_MS", 2000)) * time.Millisecond
+	cfg.ErrorBufferSize = envInt("ERROR_BUFFER_SIZE", 100)
+
+	cfg.DBDriver = strings.ToLower(envString("DB_DRIVER", "mysql"))
+	cfg.DBAutoCreate = envBool("DB_AUTO_CREATE", false)
+	// Connections that never expire outlive a MySQL failover: behind a load
+	// balancer or proxy they stay pinned to the old backend, or to a socket
+	// the middlebox has silently dropped, until a query fails on them. A
+	// finite lifetime recycles them; set 0 explicitly to keep them forever.
+	cfg.ConnMaxLifetime = time.Duration(envInt("DB_CONN_MAX_LIFETIME_SECONDS", 300)) * time.Second
+	// Each connection's lifetime is drawn from ± this percentage of the
+	// above, so connections opened together don't all expire together
+	cfg.ConnLifetimeJitter = min(max(envFloat("DB_CONN_LIFETIME_JITTER_PERCENT", 10), 0), 100) / 100
+	cfg.TxRetries = envInt("DB_TX_RETRIES", 3)
+	cfg.TxRetryBackoff = time.Duration(envInt("DB_TX_RETRY_BACKOFF_MS", 20)) * time.Millisecond
+	// Retries allowed per second across all requests; 0 removes the budget
+	cfg.RetryBudgetRate = envFloat("DB_RETRY_BUDGET_PER_SECOND", 10)
+	cfg.RetryBudgetBurst = envInt("DB_RETRY_BUDGET_BURST", 20)
+	// Negative keeps the default of queuing for a connection indefinitely
+	cfg.DBMaxWaiters = envInt("DB_MAX_WAITERS", -1)
+	// Connections opened before the service is marked ready; 0 skips warm-up
+	cfg.DBWarmupConns = envInt("DB_WARMUP_CONNS", 10)
+	// 0 leaves statements uncapped
+	cfg.DBMaxExecutionTime = time.Duration(envInt("DB_MAX_EXECUTION_TIME_MS", 0)) * time.Millisecond
+	// 0 leaves replication lag out of /health/ready. Excess lag degrades
+	// readiness unless REPLICA_LAG_CRITICAL makes it unhealthy.
+	cfg.MaxReplicaLag = time.Duration(envInt("MAX_REPLICA_LAG_SECONDS", 0)) * time.Second
+	cfg.ReplicaLagCritical = envBool("REPLICA_LAG_CRITICAL", false)
+
+	cfg.AsyncInserts = envBool("ASYNC_INSERTS", false)
+	cfg.AsyncInsertQueueSize = envInt("ASYNC_INSERT_QUEUE_SIZE", 1000)
+	cfg.AsyncInsertBatchSize = envInt("ASYNC_INSERT_BATCH_SIZE", 100)
+	// Keep each INSERT well under MySQL's max_allowed_packet
+	cfg.AsyncInsertBatchBytes = envInt("ASYNC_INSERT_BATCH_BYTES", 16<<20)
+	cfg.AsyncInsertFlushInterval = time.Duration(envInt("ASYNC_INSERT_FLUSH_MS", 50)) * time.Millisecond
+
+	cfg.AdminAPIKey = os.Getenv("ADMIN_API_KEY")
+
+	cfg.DefaultPageSize = envInt("DEFAULT_PAGE_SIZE", 20)
+	cfg.MaxPageSize = envInt("MAX_PAGE_SIZE", 100)
+	if cfg.DefaultPageSize < 1 || cfg.DefaultPageSize > cfg.MaxPageSize {
+		log.Fatalf("DEFAULT_PAGE_SIZE=%d must be between 1 and MAX_PAGE_SIZE=%d", cfg.DefaultPageSize, cfg.MaxPageSize)
+	}
+	log.Printf("Page size: default %d, max %d", cfg.DefaultPageSize, cfg.MaxPageSize)
+	cfg.SimilarAlbumsLimit = envInt("SIMILAR_ALBUMS_LIMIT", 10)
+	// Every thumbnail in a sprite is decoded and held while it is composed
+	cfg.SpriteMaxIDs = max(envInt("SPRITE_MAX_IDS", 100), 1)
+	cfg.MaxResultRows = max(envInt("MAX_RESULT_ROWS", 1000), 1)
+	// "truncate" (the default) or "reject"
+	cfg.RejectOversizedResults = envString("RESULT_OVERFLOW", "truncate") == "reject"
+	// Status for a search that matches nothing. 200 with an empty page is
+	// the default: the query itself was fine, and clients can tell "no
+	// matches" from "no such endpoint" or a typo in the path. 404 suits
+	// clients that treat a search like a lookup, at the cost of that
+	// ambiguity. Plain listings always answer 200.
+	cfg.EmptySearchNotFound = envEmptyResultStatus("EMPTY_RESULT_STATUS") == http.StatusNotFound
+	cfg.ViewFlushInterval = time.Duration(envInt("VIEW_FLUSH_INTERVAL_SECONDS", 10)) * time.Second
+
+	// 0 disables the quota
+	cfg.MaxAlbumsPerArtist = envInt("MAX_ALBUMS_PER_ARTIST", 0)
+	cfg.MaxConcurrentUploadsPerClient = envInt("MAX_CONCURRENT_UPLOADS_PER_CLIENT", 0)
+	cfg.RateLimits = make(map[string]rateLimit)
+	for _, group := range []string{rateGroupReads, rateGroupWrites, rateGroupExports} {
+		cfg.RateLimits[group] = envRateLimit(group)
+	}
+	cfg.GlobalRateLimit = rateLimit{PerSecond: envFloat("GLOBAL_RPS", 0)}
+	cfg.GlobalRateLimit.Burst = envInt("GLOBAL_BURST", max(int(math.Ceil(cfg.GlobalRateLimit.PerSecond)), 1))
+
+	cfg.NormalizeTitleCase = envBool("NORMALIZE_TITLE_CASE", false)
+
+	cfg.ArtistDenylist = loadArtistDenylist("ARTIST_DENYLIST", "ARTIST_DENYLIST_FILE", "ARTIST_DENYLIST_MODE")
+
+	cfg.FieldAliases = envFieldAliases("FORM_FIELD_ALIASES")
+	cfg.DedupCreates = envBool("DEDUP_CREATES", false)
+	cfg.DedupWindow = time.Duration(envInt("DEDUP_WINDOW_SECONDS", 10)) * time.Second
+	cfg.AllowedImageTypes = envImageTypes("ALLOWED_IMAGE_TYPES")
+	// Capped at the image column's size once the database is open, unless
+	// LARGE_IMAGES widens the column. Uploads are also bounded by
+	// MAX_REQUEST_BYTES, so raise both together.
+	cfg.MaxImageBytes = envInt("MAX_IMAGE_BYTES", 10<<20)
+	cfg.LargeImages = envBool("LARGE_IMAGES", false)
+	// Width times height; 0 disables the check
+	cfg.MaxImagePixels = int64(envInt("MAX_IMAGE_PIXELS", 50_000_000))
+	// Off by default: a full decode costs as much as rendering the thumbnail
+	cfg.VerifyImageDecode = envBool("VERIFY_IMAGE_DECODE", false)
+	// JPEGs larger than this many bytes are recompressed before they are
+	// stored, at no lower than RECOMPRESS_MIN_QUALITY; 0 disables it
+	cfg.RecompressAbove = envInt("RECOMPRESS_ABOVE_BYTES", 0)
+	cfg.RecompressFloor = envInt("RECOMPRESS_MIN_QUALITY", 60)
+	// Accept years like "199X" or "c. 1985" on upload; see fuzzyyear.go
+	cfg.AllowFuzzyYear = envBool("ALLOW_FUZZY_YEAR", false)
+	cfg.MaxFormParts = envInt("MAX_FORM_PARTS", 16)
+	cfg.UploadDir = envString("UPLOAD_DIR", filepath.Join(os.TempDir(), "album-uploads"))
+	// Spooling keeps uploads that are still arriving on disk rather than in
+	// memory; the image is read back once the form has been checked
+	cfg.SpoolUploads = envBool("SPOOL_UPLOADS", false)
+	cfg.SpoolDir = envString("UPLOAD_SPOOL_DIR", os.TempDir())
+	cfg.UploadTTL = time.Duration(envInt("UPLOAD_TTL_MINUTES", 60)) * time.Minute
+	cfg.ThumbnailWidth = envInt("THUMBNAIL_WIDTH", 200)
+	cfg.ThumbnailQuality = envInt("THUMBNAIL_QUALITY", 80)
+	cfg.ThumbnailMaxWidth = envInt("THUMBNAIL_MAX_WIDTH", 800)
+	cfg.ThumbnailCacheSize = envInt("THUMBNAIL_CACHE_SIZE", 256)
+	cfg.ConvertedCacheSize = envInt("CONVERTED_IMAGE_CACHE_SIZE", 64)
+	cfg.CardCacheSize = envInt("CARD_CACHE_SIZE", 64)
+	cfg.ThumbnailWorkers = max(envInt("THUMBNAIL_WORKERS", 4), 1)
+
+	// Without a bucket, POST /albums/upload-url and the confirm step answer
+	// 404. S3_ENDPOINT switches to path-style URLs on another host, for
+	// MinIO or a local stand-in.
+	cfg.S3Bucket = os.Getenv("S3_BUCKET")
+	cfg.S3Region = envString("S3_REGION", "us-east-1")
+	cfg.S3Endpoint = strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/")
+	cfg.S3UploadPrefix = envString("S3_UPLOAD_PREFIX", "album-uploads/")
+	cfg.S3UploadURLTTL = time.Duration(envInt("S3_UPLOAD_URL_TTL_SECONDS", 900)) * time.Second
+	cfg.AWSAccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	cfg.AWSSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	cfg.AWSSessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if cfg.S3Bucket != "" && (cfg.AWSAccessKeyID == "" || cfg.AWSSecretAccessKey == "") {
+		log.Fatalf("S3_BUCKET=%s needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", cfg.S3Bucket)
+	}
+}
+
+// fieldAliases returns the form field names accepted for a canonical field,
+// canonical name first
+func fieldAliases(field string) []string {
+	return append([]string{field}, cfg.FieldAliases[field]...)
+}
+
+// envFieldAliases parses extra upload field names in the form
+// "image=cover|art,title=name". The canonical names are always accepted.
+func envFieldAliases(key string) map[string][]string {
+	aliases := make(map[string][]string)
+	for _, entry := range envList(key, nil) {
+		field, names, ok := strings.Cut(entry, "=")
+		field = strings.TrimSpace(field)
+		if !ok || field == "" {
+			log.Printf("Ignoring invalid %s entry %q", key, entry)
+			continue
+		}
+		for _, name := range strings.Split(names, "|") {
+			if name = strings.TrimSpace(name); name != "" && name != field {
+				aliases[field] = append(aliases[field], name)
+			}
+		}
+	}
+	return aliases
+}
+
+// envImageTypes parses a comma-separated list of image MIME types to accept
+// for upload. Types the service can't validate are logged and skipped; with
+// nothing usable left, every supported type is allowed.
+func envImageTypes(key string) map[string]bool {
+	supported := make(map[string]bool)
+	for _, contentType := range allowedImageExtensions {
+		supported[contentType] = true
+	}
+
+	allowed := make(map[string]bool)
+	for _, contentType := range envList(key, nil) {
+		contentType = strings.ToLower(contentType)
+		if !supported[contentType] {
+			log.Printf("Ignoring unsupported %s entry %q", key, contentType)
+			continue
+		}
+		allowed[contentType] = true
+	}
+	if len(allowed) == 0 {
+		allowed = supported
+	}
+
+	types := make([]string, 0, len(allowed))
+	for contentType := range allowed {
+		types = append(types, contentType)
+	}
+	slices.Sort(types)
+	log.Printf("Allowed image types: %s", strings.Join(types, ", "))
+	return allowed
+}
+
+// envEmptyResultStatus reads key as 200 or 404, defaulting to 200
+func envEmptyResultStatus(key string) int {
+	switch status := envInt(key, http.StatusOK); status {
+	case http.StatusOK, http.StatusNotFound:
+		return status
+	default:
+		log.Printf("Ignoring invalid %s=%d: must be 200 or 404", key, status)
+		return http.StatusOK
+	}
+}
+
+// envString returns the value of key, or def when it is unset or empty
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envBool parses key as a boolean, falling back to def on absence or error
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return b
+}
+
+// envInt parses key as an integer, falling back to def on absence or error
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return n
+}
+
+// envFloat parses key as a float, falling back to def on absence or error
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return f
+}
+
+// envList splits a comma-separated key into trimmed, non-empty entries
+func envList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// secretConfigFields are the cfg fields /debug/config only reports as set or
+// unset
+var secretConfigFields = map[string]bool{
+	"AdminAPIKey":        true,
+	"AWSSecretAccessKey": true,
+	"AWSSessionToken":    true,
+}
+
+// redactedValue replaces secrets in /debug/config
+const redactedValue = "REDACTED"
+
+// DebugConfig reports the configuration the server resolved at startup, as
+// JSON keyed by setting. Durations are rendered like "1.5s", secrets are
+// redacted and the DSNs are shown without their passwords.
+func debugConfig(c *gin.Context) {
+	settings := make(map[string]any)
+	v := reflect.ValueOf(cfg)
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i).Interface()
+		if secretConfigFields[field.Name] {
+			if value != "" {
+				value = redactedValue
+			}
+		} else if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		settings[lowerCamel(field.Name)] = value
+	}
+
+	database := gin.H{"maxOpenConns": poolMaxOpenConns, "maxIdleConns": poolMaxIdleConns,
+		"dsn": redactDSN(os.Getenv("DB_DSN"))}
+	if readDSN := os.Getenv("DB_READ_DSN"); readDSN != "" {
+		database["readDsn"] = redactDSN(readDSN)
+	}
+	c.JSON(http.StatusOK, gin.H{"config": settings, "database": database})
+}
+
+// redactDSN replaces the password in a MySQL DSN. A DSN that doesn't parse
+// is withheld entirely, since there is no telling where its password is.
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+	dsnConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return redactedValue
+	}
+	if dsnConfig.Passwd != "" {
+		dsnConfig.Passwd = redactedValue
+	}
+	return dsnConfig.FormatDSN()
+}
+
+// lowerCamel turns a Go field name into a JSON key, lowering a leading
+// acronym as a whole: DBDriver becomes dbDriver and TxRetries txRetries
+func lowerCamel(name string) string {
+	runes := []rune(name)
+	n := 0
+	for n < len(runes) && unicode.IsUpper(runes[n]) {
+		n++
+	}
+	// Keep the capital that starts the next word
+	if n > 1 && n < len(runes) {
+		n--
+	}
+	for i := range n {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand/v2"
+	"time"
+)
+
+// With a single ConnMaxLifetime, connections opened together in a burst
+// (at startup, or after a failover) also expire together, and the pool
+// reconnects all of them at once. jitterConnector gives every connection its
+// own lifetime drawn from lifetime ± jitter, so expirations spread out.
+//
+// database/sql only applies one lifetime to the whole pool, so the per-
+// connection deadline is enforced through driver.Validator: the pool asks
+// IsValid before reusing a connection and discards it once it reports false.
+// The pool's own ConnMaxLifetime is set to the top of the range as a backstop
+// that closes idle connections nobody asks for.
+
+// jitterConnector wraps a driver.Connector and tags each new connection with
+// a randomized expiry
+type jitterConnector struct {
+	driver.Connector
+	lifetime time.Duration
+	jitter   float64 // fraction of lifetime, 0 to 1
+}
+
+// maxLifetime is the longest lifetime any connection can be given
+func (jc *jitterConnector) maxLifetime() time.Duration {
+	return jc.lifetime + time.Duration(float64(jc.lifetime)*jc.jitter)
+}
+
+// Connect opens a connection that reports itself invalid once its own
+// lifetime has passed
+func (jc *jitterConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := jc.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	spread := time.Duration(float64(jc.lifetime) * jc.jitter * (2*rand.Float64() - 1))
+	return &jitterConn{Conn: conn, expires: time.Now().Add(jc.lifetime + spread)}, nil
+}
+
+// jitterConn forwards to the driver's connection, passing through each
+// optional interface the MySQL driver implements so database/sql keeps using
+// the fast paths
+type jitterConn struct {
+	driver.Conn
+	expires time.Time
+}
+
+// IsValid reports false once the connection is past its expiry, or when the
+// driver itself considers the connection broken
+func (c *jitterConn) IsValid() bool {
+	if time.Now().After(c.expires) {
+		return false
+	}
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *jitterConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *jitterConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *jitterConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *jitterConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *jitterConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *jitterConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *jitterConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsMiddleware applies the configured cross-origin policy. With credentials
+// enabled the browser rejects a wildcard origin, so the request's Origin is
+// echoed back, but only after it has been matched against the allowlist.
+func corsMiddleware() gin.HandlerFunc {
+	allowAny := false
+	origins := make(map[string]bool)
+	for _, o := range cfg.CORSAllowedOrigins {
+		if o == "*" {
+			allowAny = true
+			continue
+		}
+		origins[strings.TrimSuffix(o, "/")] = true
+	}
+	if allowAny && cfg.CORSAllowCredentials {
+		log.Printf("CORS: ignoring wildcard origin because credentials are enabled")
+		allowAny = false
+	}
+
+	methods := make(map[string]bool)
+	for _, m := range cfg.CORSAllowedMethods {
+		methods[strings.ToUpper(m)] = true
+	}
+	allowMethods := strings.Join(cfg.CORSAllowedMethods, ", ")
+	allowHeaders := strings.Join(cfg.CORSAllowedHeaders, ", ")
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		// The response differs per origin, so caches must key on it
+		c.Header("Vary", "Origin")
+		if !allowAny && !origins[origin] {
+			c.Next()
+			return
+		}
+
+		if cfg.CORSAllowCredentials {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+		} else if allowAny {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+
+		// Answer preflight requests directly
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			if !methods[strings.ToUpper(c.GetHeader("Access-Control-Request-Method"))] {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Header("Access-Control-Allow-Methods", allowMethods)
+			c.Header("Access-Control-Allow-Headers", allowHeaders)
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL server error numbers handled explicitly
+const (
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+	errUnknownDatabase = 1049
+	errQueryTimeout    = 3024
+	errDataTooLong     = 1406
+	errSyntax          = 1064
+	errDuplicateKey    = 1062
+	errDiskFull        = 1021
+	errTableFull       = 1114
+	errWritingFile     = 3
+	errStorageEngine   = 1030
+)
+
+// Sentinel errors returned from withTx callbacks to abort the transaction
+var (
+	errAlbumNotFound   = errors.New("album not found")
+	errVersionConflict = errors.New("album version conflict")
+	errArtistQuota     = errors.New("artist album quota reached")
+	errImageChanged    = errors.New("album image changed")
+	// An upsert's ON DUPLICATE KEY UPDATE fired on another album's UPC or
+	// ISRC instead of the upsert claim
+	errUpsertCodeTaken = errors.New("upsert matched another album's code")
+)
+
+// Connection pool sizes, applied to every pool
+const (
+	poolMaxOpenConns = 88
+	poolMaxIdleConns = 30
+)
+
+// Global DB instances. readDB serves the read-heavy endpoints and is the
+// same pool as db unless DB_READ_DSN names a replica.
+var db, readDB *sql.DB
+
+func initDB() {
+	retryTokens = newTokenBucket(cfg.RetryBudgetRate, cfg.RetryBudgetBurst)
+
+	// Read MySQL DSN from environment variable
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		log.Fatal("DB_DSN environment variable not set")
+	}
+	if err := checkDriverDSN(cfg.DBDriver, dsn); err != nil {
+		log.Fatal(err)
+	}
+	db, dsn = openPool("DB_DSN", dsn)
+
+	// Test the DB connection, creating the database first if allowed
+	err := db.Ping()
+	if isUnknownDatabase(err) {
+		if !cfg.DBAutoCreate {
+			log.Fatalf("Database in DB_DSN does not exist; create it first or set DB_AUTO_CREATE=true (%v)", err)
+		}
+		if err = createDatabase(dsn); err != nil {
+			log.Fatalf("Failed to create database: %v", err)
+		}
+		err = db.Ping()
+	}
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %v", err)
+	}
+
+	readDB = db
+	if readDSN := os.Getenv("DB_READ_DSN"); readDSN != "" {
+		if err := checkDriverDSN(cfg.DBDriver, readDSN); err != nil {
+			log.Fatal(strings.ReplaceAll(err.Error(), "DB_DSN", "DB_READ_DSN"))
+		}
+		readDB, _ = openPool("DB_READ_DSN", readDSN)
+		if err := readDB.Ping(); err != nil {
+			log.Fatalf("Failed to connect to read DB: %v", err)
+		}
+	}
+
+	// Bring the schema up to date
+	if err = runMigrations(); err != nil {
+		log.Fatalf("Failed to migrate schema: %v", err)
+	}
+	if err = verifyIndexes(); err != nil {
+		log.Printf("Failed to verify indexes: %v", err)
+	}
+	if err = checkImageColumn(); err != nil {
+		log.Fatalf("Failed to check image column: %v", err)
+	}
+}
+
+// closeDB closes both pools
+func closeDB() {
+	if readDB != db {
+		readDB.Close()
+	}
+	db.Close()
+}
+
+// openPool opens a connection pool for the DSN in the named variable with
+// the enforced parameters and pool settings, without connecting yet. It also
+// returns the DSN as rewritten.
+func openPool(name, dsn string) (*sql.DB, string) {
+	dsnConfig, err := enforceDSNParams(dsn)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	log.Printf("%s: user=%s addr=%s db=%s parseTime=%t charset=%s collation=%s", name,
+		dsnConfig.User, dsnConfig.Addr, dsnConfig.DBName, dsnConfig.ParseTime, requiredCharset, dsnConfig.Collation)
+	// Session variables in Params are set by the driver on every new
+	// connection. MySQL only applies this cap to SELECT statements.
+	if cfg.DBMaxExecutionTime > 0 {
+		if dsnConfig.Params == nil {
+			dsnConfig.Params = make(map[string]string)
+		}
+		dsnConfig.Params["max_execution_time"] = strconv.FormatInt(cfg.DBMaxExecutionTime.Milliseconds(), 10)
+		log.Printf("%s: max_execution_time=%v", name, cfg.DBMaxExecutionTime)
+	}
+
+	var connector driver.Connector
+	if connector, err = mysql.NewConnector(dsnConfig); err != nil {
+		log.Fatalf("Failed to open %s: %v", name, err)
+	}
+	maxLifetime := cfg.ConnMaxLifetime
+	if cfg.ConnLifetimeJitter > 0 && cfg.ConnMaxLifetime > 0 {
+		jc := &jitterConnector{Connector: connector, lifetime: cfg.ConnMaxLifetime, jitter: cfg.ConnLifetimeJitter}
+		connector, maxLifetime = jc, jc.maxLifetime()
+		log.Printf("%s: connection lifetime %v ± %.0f%%", name, cfg.ConnMaxLifetime, cfg.ConnLifetimeJitter*100)
+	}
+	pool := sql.OpenDB(connector)
+
+	// Set connection pooling configurations
+	pool.SetMaxOpenConns(poolMaxOpenConns)
+	pool.SetMaxIdleConns(poolMaxIdleConns)
+	pool.SetConnMaxLifetime(maxLifetime)
+	return pool, dsnConfig.FormatDSN()
+}
+
+// checkDriverDSN rejects driver settings this build can't serve and DSNs
+// written for another database, before anything tries to connect with them
+func checkDriverDSN(driver, dsn string) error {
+	if driver != "mysql" {
+		return fmt.Errorf("DB_DRIVER=%q is not supported; only mysql is built in", driver)
+	}
+	lower := strings.ToLower(dsn)
+	switch {
+	case strings.HasPrefix(lower, "postgres://"), strings.HasPrefix(lower, "postgresql://"),
+		strings.Contains(lower, "sslmode="), strings.HasPrefix(lower, "host="):
+		return fmt.Errorf("DB_DSN looks like a PostgreSQL DSN but DB_DRIVER is mysql; " +
+			"expected user:password@tcp(host:3306)/dbname")
+	case strings.HasPrefix(lower, "mysql://"):
+		return fmt.Errorf("DB_DSN must not be a mysql:// URL; " +
+			"expected user:password@tcp(host:3306)/dbname")
+	case strings.HasPrefix(lower, "sqlserver://"), strings.HasPrefix(lower, "file:"), strings.HasSuffix(lower, ".db"):
+		return fmt.Errorf("DB_DSN is for a different database but DB_DRIVER is mysql; " +
+			"expected user:password@tcp(host:3306)/dbname")
+	}
+	if _, err := mysql.ParseDSN(dsn); err != nil {
+		return fmt.Errorf("DB_DSN is not a valid MySQL DSN (expected user:password@tcp(host:3306)/dbname): %v", err)
+	}
+	return nil
+}
+
+// Connection parameters every DSN is forced to use. Without parseTime,
+// DATETIME and TIMESTAMP columns can't be scanned into time.Time, and anything
+// short of utf8mb4 mangles non-BMP characters in artist names.
+const (
+	requiredCharset   = "utf8mb4"
+	requiredCollation = "utf8mb4_unicode_ci"
+)
+
+// enforceDSNParams parses dsn and sets parseTime, charset and collation,
+// overriding conflicting values with a warning
+func enforceDSNParams(dsn string) (*mysql.Config, error) {
+	dsnConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if c := dsnConfig.Collation; c != "" && c != requiredCollation {
+		log.Printf("Overriding DSN collation %s with %s", c, requiredCollation)
+	}
+	dsnConfig.ParseTime = true
+	dsnConfig.Collation = requiredCollation
+
+	// The charset isn't exposed on mysql.Config, so set it through the DSN
+	// text. Parameters are always present and escaped after the last '?'.
+	formatted := dsnConfig.FormatDSN()
+	i := strings.LastIndex(formatted, "?")
+	params, err := url.ParseQuery(formatted[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	if cs := params.Get("charset"); cs != "" && cs != requiredCharset {
+		log.Printf("Overriding DSN charset %s with %s", cs, requiredCharset)
+	}
+	params.Set("charset", requiredCharset)
+	return mysql.ParseDSN(formatted[:i] + "?" + params.Encode())
+}
+
+// isMySQLError reports whether err is a MySQL server error with one of the
+// given error numbers
+func isMySQLError(err error, numbers ...uint16) bool {
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return false
+	}
+	for _, n := range numbers {
+		if myErr.Number == n {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnknownDatabase reports whether err is MySQL's "unknown database" error
+func isUnknownDatabase(err error) bool {
+	return isMySQLError(err, errUnknownDatabase)
+}
+
+// osErrNoSpace matches the OS error 28 (ENOSPC) MySQL embeds in file write
+// and storage engine errors
+var osErrNoSpace = regexp.MustCompile(`(?:Errcode: |[Ee]rror )28\b`)
+
+// isDiskFull reports whether err means MySQL ran out of disk space: the disk
+// full and table full errors, or a write failing with ENOSPC
+func isDiskFull(err error) bool {
+	if isMySQLError(err, errDiskFull, errTableFull) {
+		return true
+	}
+	return isMySQLError(err, errWritingFile, errStorageEngine) && osErrNoSpace.MatchString(err.Error())
+}
+
+// isRetryableTxError reports whether err aborted a transaction that is safe
+// to run again from the start
+func isRetryableTxError(err error) bool {
+	return isMySQLError(err, errDeadlock, errLockWaitTimeout)
+}
+
+// isBadConn reports whether err means the connection died under a statement,
+// as happens to in-flight queries during a failover. database/sql already
+// retries driver.ErrBadConn when nothing was sent; mysql.ErrInvalidConn is
+// what the driver reports once the statement was already on the wire.
+func isBadConn(err error) bool {
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn)
+}
+
+// readQuery is db.QueryContext for read-only statements, retried once on a
+// fresh connection when the first one drops. Never use it for writes: a
+// dropped write may still have been applied. Handlers pass the request's
+// context, so a query is cancelled when its client disconnects.
+func readQuery(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return queryPool(ctx, db, query, args...)
+}
+
+// replicaQuery is readQuery on the read pool, for endpoints that can serve
+// data a replica may not have caught up on yet
+func replicaQuery(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return queryPool(ctx, readDB, query, args...)
+}
+
+// queryPool runs a read-only query on pool with readQuery's retry
+func queryPool(ctx context.Context, pool *sql.DB, query string, args ...any) (*sql.Rows, error) {
+	rows, err := pool.QueryContext(ctx, query, args...)
+	if isBadConn(err) && takeRetry(&dbRetries.read) {
+		log.Printf("Retrying query after dropped connection: %v", err)
+		rows, err = pool.QueryContext(ctx, query, args...)
+	}
+	logQueryTimeout(err, query)
+	return rows, err
+}
+
+// logQueryTimeout logs queries the server killed for running past
+// max_execution_time
+func logQueryTimeout(err error, query string) {
+	if isMySQLError(err, errQueryTimeout) {
+		log.Printf("Query killed after exceeding max_execution_time: %s", strings.Join(strings.Fields(query), " "))
+	}
+}
+
+// readRow is the result of readQueryRow
+type readRow struct {
+	ctx   context.Context
+	pool  *sql.DB
+	query string
+	args  []any
+}
+
+// readQueryRow is db.QueryRowContext with readQuery's retry
+func readQueryRow(ctx context.Context, query string, args ...any) readRow {
+	return readRow{ctx: ctx, pool: db, query: query, args: args}
+}
+
+// replicaQueryRow is readQueryRow on the read pool
+func replicaQueryRow(ctx context.Context, query string, args ...any) readRow {
+	return readRow{ctx: ctx, pool: readDB, query: query, args: args}
+}
+
+// Scan runs the query and scans its first row like sql.Row.Scan
+func (r readRow) Scan(dest ...any) error {
+	err := r.pool.QueryRowContext(r.ctx, r.query, r.args...).Scan(dest...)
+	if isBadConn(err) && takeRetry(&dbRetries.read) {
+		log.Printf("Retrying query after dropped connection: %v", err)
+		err = r.pool.QueryRowContext(r.ctx, r.query, r.args...).Scan(dest...)
+	}
+	logQueryTimeout(err, r.query)
+	return err
+}
+
+// withTx runs fn inside a fresh transaction and commits it if fn succeeds.
+// When MySQL aborts the transaction with a deadlock or lock wait timeout, the
+// whole transaction is rolled back and fn runs again in a new one, so fn must
+// not have side effects outside tx. Retries are capped at DB_TX_RETRIES with
+// a jittered exponential backoff.
+//
+// A connection dropped before COMMIT was sent takes the uncommitted work with
+// it, so that is retried once on a fresh connection too. A drop during COMMIT
+// is returned as is, since the transaction may or may not have committed.
+//
+// Both kinds of retry count against the same DB_TX_RETRIES, and each one
+// also needs a token from the process-wide retry budget.
+//
+// Once ctx is cancelled the transaction is rolled back and not retried.
+func withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	retriedBadConn := false
+	for attempt := 0; ; attempt++ {
+		committing, err := runTx(ctx, fn)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isBadConn(err) && !committing && !retriedBadConn && attempt < cfg.TxRetries && takeRetry(&dbRetries.badConn) {
+			retriedBadConn = true
+			log.Printf("Retrying transaction after dropped connection (attempt %d): %v", attempt+1, err)
+			continue
+		}
+		if err == nil || !isRetryableTxError(err) || attempt >= cfg.TxRetries || !takeRetry(&dbRetries.tx) {
+			return err
+		}
+
+		backoff := cfg.TxRetryBackoff << attempt
+		backoff += time.Duration(rand.Int64N(int64(backoff) + 1))
+		log.Printf("Retrying transaction after %v (attempt %d): %v", backoff, attempt+1, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runTx makes a single attempt at running fn in a transaction. committing
+// reports whether err came from the COMMIT itself. database/sql rolls the
+// transaction back as soon as ctx is cancelled; a statement already running
+// finishes first, and everything after it fails with sql.ErrTxDone.
+func runTx(ctx context.Context, fn func(tx *sql.Tx) error) (committing bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	// Rolling back after a successful commit is a no-op
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// dataTooLongColumn extracts the column from MySQL's "Data too long" error
+var dataTooLongColumn = regexp.MustCompile(`Data too long for column '([^']+)'`)
+
+// respondTxError writes the response for a failed write transaction:
+//   - a database out of disk space: 507
+//   - a duplicate album code: 409
+//   - a value too long for its column: 400
+//   - lock contention that outlasted every retry: 503, so clients back off
+//     and try again
+//   - anything else: 500 carrying msg
+//
+// Nothing is written when the client has already disconnected.
+func respondTxError(c *gin.Context, err error, msg string) {
+	if clientGone(c) {
+		return
+	}
+	if isDiskFull(err) {
+		// Loud on purpose: nothing can be written until ops frees space
+		log.Printf("ALERT: database is out of disk space, writes are failing: %v", err)
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Database is out of storage space"})
+		return
+	}
+	// The UPC and ISRC indexes are the only unique keys clients can collide on
+	if isMySQLError(err, errDuplicateKey) {
+		c.JSON(http.StatusConflict, gin.H{"error": "UPC or ISRC is already assigned to another album"})
+		return
+	}
+	if isMySQLError(err, errDataTooLong) {
+		column := "a field"
+		if m := dataTooLongColumn.FindStringSubmatch(err.Error()); m != nil {
+			column = m[1]
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Value for " + column + " is too large to store"})
+		return
+	}
+	if isRetryableTxError(err) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database is busy, please retry"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+}
+
+// createDatabase connects to the server named in dsn without selecting a
+// database and creates the database dsn refers to
+func createDatabase(dsn string) error {
+	dsnConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	name := dsnConfig.DBName
+	dsnConfig.DBName = ""
+
+	server, err := sql.Open("mysql", dsnConfig.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	_, err = server.Exec("CREATE DATABASE IF NOT EXISTS `" + strings.ReplaceAll(name, "`", "``") + "`")
+	if err != nil {
+		return err
+	}
+	log.Printf("Created database %s", name)
+	return nil
+}
+
+// poolStats is the JSON form of sql.DBStats
+type poolStats struct {
+	MaxOpen           int     `json:"maxOpen"`
+	Open              int     `json:"open"`
+	InUse             int     `json:"inUse"`
+	Idle              int     `json:"idle"`
+	WaitCount         int64   `json:"waitCount"`
+	WaitSeconds       float64 `json:"waitSeconds"`
+	MaxIdleClosed     int64   `json:"maxIdleClosed"`
+	MaxLifetimeClosed int64   `json:"maxLifetimeClosed"`
+}
+
+func newPoolStats(s sql.DBStats) poolStats {
+	return poolStats{MaxOpen: s.MaxOpenConnections, Open: s.OpenConnections, InUse: s.InUse, Idle: s.Idle,
+		WaitCount: s.WaitCount, WaitSeconds: s.WaitDuration.Seconds(),
+		MaxIdleClosed: s.MaxIdleClosed, MaxLifetimeClosed: s.MaxLifetimeClosed}
+}
+
+// DebugDBPools reports connection pool statistics for the primary and, when
+// DB_READ_DSN is set, the read pool, along with retry counts
+func debugDBPools(c *gin.Context) {
+	pools := gin.H{"primary": newPoolStats(db.Stats())}
+	if readDB != db {
+		pools["read"] = newPoolStats(readDB.Stats())
+	}
+	pools["retries"] = gin.H{
+		"transaction":   dbRetries.tx.Load(),
+		"badConnection": dbRetries.badConn.Load(),
+		"read":          dbRetries.read.Load(),
+		"denied":        dbRetries.denied.Load(),
+		"budgetTokens":  retryTokens.available(),
+	}
+	c.JSON(http.StatusOK, pools)
+}
+
+// dbRetries counts the retries taken, by kind, and those the budget denied
+var dbRetries struct {
+	tx, badConn, read, denied atomic.Int64
+}
+
+// retryTokens is the process-wide retry budget: a token bucket refilled at
+// DB_RETRY_BUDGET_PER_SECOND up to DB_RETRY_BUDGET_BURST. When the database
+// is struggling, unbounded retries from every request multiply its load;
+// with the budget spent, failures are returned on the first attempt instead.
+// It is created by initDB.
+var retryTokens *tokenBucket
+
+// tokenBucket is a mutex-guarded token bucket holding up to burst tokens,
+// refilled at rate per second. A non-positive rate means unlimited.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst}
+}
+
+// refill adds the tokens accrued since the last call. mu must be held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(b.burst)
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, float64(b.burst))
+	}
+	b.last = now
+}
+
+// take removes one token, reporting false when none are left
+func (b *tokenBucket) take() bool {
+	ok, _ := b.reserve()
+	return ok
+}
+
+// reserve is take that also reports, when no token is left, how long until
+// the next one accrues
+func (b *tokenBucket) reserve() (ok bool, wait time.Duration) {
+	if b.rate <= 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// available reports the whole tokens left, or -1 when unlimited
+func (b *tokenBucket) available() int {
+	if b.rate <= 0 {
+		return -1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return int(b.tokens)
+}
+
+// takeRetry spends a retry token, counting the retry under kind, or counts
+// and logs the denial when the budget is exhausted
+func takeRetry(kind *atomic.Int64) bool {
+	if !retryTokens.take() {
+		log.Printf("DB retry budget exhausted, not retrying (%d denied so far)", dbRetries.denied.Add(1))
+		return false
+	}
+	kind.Add(1)
+	return true
+}
+
+// warmPool opens up to n connections on each pool concurrently, so the first
+// requests after startup don't all pay for a connection handshake. Failures
+// are only logged; the pool opens connections on demand anyway.
+func warmPool(n int) {
+	// Beyond the idle limit they would just be closed again
+	n = min(n, poolMaxIdleConns)
+	if n <= 0 {
+		return
+	}
+	pools := []*sql.DB{db}
+	if readDB != db {
+		pools = append(pools, readDB)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		// Hold every connection until all are open, or they would be reused
+		conns := make([]*sql.Conn, n)
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := pool.Conn(context.Background())
+				if err != nil {
+					log.Printf("DB warm-up connection failed: %v", err)
+					return
+				}
+				// Kept even if the ping fails, so it is closed with the rest
+				conns[i] = conn
+				if err := conn.PingContext(context.Background()); err != nil {
+					log.Printf("DB warm-up connection failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+	log.Printf("DB: warmed up %d connections per pool in %v", n, time.Since(start).Round(time.Millisecond))
+}
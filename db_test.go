@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// dropFirst returns a fake database handler that fails the first statement
+// matching prefix with dropErr and answers every statement with one row
+// holding 1
+func dropFirst(prefix string, dropErr error, calls *int) func(string, []driver.NamedValue) (fakeResult, error) {
+	return func(query string, args []driver.NamedValue) (fakeResult, error) {
+		if queryIs(query, prefix) {
+			*calls++
+			if *calls == 1 {
+				return fakeResult{}, dropErr
+			}
+		}
+		return fakeResult{rows: [][]driver.Value{{int64(1)}}, affected: 1}, nil
+	}
+}
+
+// dropErrors are the ways a connection can die under a statement: before it
+// was sent, which database/sql retries itself, and after
+var dropErrors = map[string]error{
+	"ErrBadConn":     driver.ErrBadConn,
+	"ErrInvalidConn": mysql.ErrInvalidConn,
+}
+
+func TestReadQueryRetriesDroppedConnection(t *testing.T) {
+	for name, dropErr := range dropErrors {
+		t.Run(name, func(t *testing.T) {
+			var calls int
+			useFakeDB(t, dropFirst("SELECT", dropErr, &calls))
+
+			rows, err := readQuery(context.Background(), "SELECT 1")
+			if err != nil {
+				t.Fatalf("readQuery: %v", err)
+			}
+			rows.Close()
+			if calls != 2 {
+				t.Errorf("query ran %d times, want 2", calls)
+			}
+		})
+	}
+}
+
+func TestReadQueryRowRetriesDroppedConnection(t *testing.T) {
+	for name, dropErr := range dropErrors {
+		t.Run(name, func(t *testing.T) {
+			var calls int
+			useFakeDB(t, dropFirst("SELECT", dropErr, &calls))
+
+			var n int
+			if err := readQueryRow(context.Background(), "SELECT 1").Scan(&n); err != nil {
+				t.Fatalf("Scan: %v", err)
+			}
+			if n != 1 || calls != 2 {
+				t.Errorf("got %d after %d attempts, want 1 after 2", n, calls)
+			}
+		})
+	}
+}
+
+func TestWithTxRetriesDroppedConnection(t *testing.T) {
+	var calls int
+	fdb := useFakeDB(t, dropFirst("UPDATE", mysql.ErrInvalidConn, &calls))
+
+	err := withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE Albums SET title = ? WHERE id = ?", "t", 1)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("withTx: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("statement ran %d times, want 2", calls)
+	}
+	if want := []string{"begin", "rollback", "begin", "commit"}; !slices.Equal(fdb.events, want) {
+		t.Errorf("events = %v, want %v", fdb.events, want)
+	}
+	if applied := fdb.appliedStatements(); len(applied) != 1 {
+		t.Errorf("applied %d statements, want 1", len(applied))
+	}
+}
+
+func TestWithTxGivesUpAfterOneDroppedConnectionRetry(t *testing.T) {
+	fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		return fakeResult{}, mysql.ErrInvalidConn
+	})
+
+	err := withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE Albums SET title = ? WHERE id = ?", "t", 1)
+		return err
+	})
+	if !errors.Is(err, mysql.ErrInvalidConn) {
+		t.Fatalf("withTx error = %v, want %v", err, mysql.ErrInvalidConn)
+	}
+	if fdb.hasEvent("commit") {
+		t.Error("transaction committed despite the failures")
+	}
+}
+
+func TestWarmPoolReleasesConnectionsThatFailPing(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		if query == "PING" {
+			return fakeResult{}, errors.New("simulated ping failure")
+		}
+		return fakeResult{}, nil
+	})
+
+	warmPool(3)
+
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Errorf("%d warm-up connections still held after failed pings", inUse)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// recentCreates remembers album creations by request fingerprint for
+// DEDUP_WINDOW_SECONDS, so a double-submitted create returns the album the
+// first one made instead of inserting another
+var recentCreates = struct {
+	sync.Mutex
+	entries map[string]*dedupEntry
+}{entries: make(map[string]*dedupEntry)}
+
+// dedupEntry is a create that is in progress or finished. done is closed once
+// albumID and err are set.
+type dedupEntry struct {
+	done    chan struct{}
+	albumID int64
+	err     error
+	expires time.Time
+}
+
+// createFingerprint hashes everything that defines a create request. The
+// client is part of it, so identical uploads from different clients stay
+// separate albums.
+func createFingerprint(actor string, in *albumInput) string {
+	h := sha256.New()
+	writeField := func(b []byte) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	optional := func(v *int) []byte {
+		if v == nil {
+			return nil
+		}
+		return binary.BigEndian.AppendUint64([]byte{1}, uint64(*v))
+	}
+	writeField([]byte(actor))
+	writeField([]byte(in.artist))
+	writeField([]byte(in.title))
+	writeField(binary.BigEndian.AppendUint64(nil, uint64(in.year)))
+	if in.yearText != nil {
+		writeField([]byte(*in.yearText))
+	} else {
+		writeField(nil)
+	}
+	writeField([]byte(in.filename))
+	writeField(optional(in.trackCount))
+	writeField(optional(in.durationSeconds))
+	for _, code := range []*string{in.upc, in.isrc} {
+		if code != nil {
+			writeField([]byte(*code))
+		} else {
+			writeField(nil)
+		}
+	}
+	writeField(in.image)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claimCreate returns the entry for key. owner is true when the caller must
+// perform the create and then call finishCreate; otherwise the entry belongs
+// to an earlier identical request.
+func claimCreate(key string) (entry *dedupEntry, owner bool) {
+	recentCreates.Lock()
+	defer recentCreates.Unlock()
+
+	now := time.Now()
+	for k, e := range recentCreates.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(recentCreates.entries, k)
+		}
+	}
+	if e, ok := recentCreates.entries[key]; ok {
+		return e, false
+	}
+	e := &dedupEntry{done: make(chan struct{})}
+	recentCreates.entries[key] = e
+	return e, true
+}
+
+// finishCreate records the outcome of a claimed create. Failures are
+// forgotten straight away so that a retry can succeed.
+func finishCreate(key string, e *dedupEntry, albumID int64, err error) {
+	recentCreates.Lock()
+	e.albumID, e.err = albumID, err
+	e.expires = time.Now().Add(cfg.DedupWindow)
+	if err != nil {
+		delete(recentCreates.entries, key)
+	}
+	recentCreates.Unlock()
+	close(e.done)
+}
+
+// createAlbumOnce is createAlbumRecord with deduplication of identical
+// requests inside the window. deduped reports that albumID came from an
+// earlier request.
+func createAlbumOnce(ctx context.Context, in *albumInput, actor string) (albumID int64, deduped bool, err error) {
+	if !cfg.DedupCreates {
+		albumID, err = createAlbumRecord(ctx, in, actor)
+		return albumID, false, err
+	}
+
+	key := createFingerprint(actor, in)
+	entry, owner := claimCreate(key)
+	if !owner {
+		<-entry.done
+		if entry.err == nil {
+			return entry.albumID, true, nil
+		}
+		// The first attempt failed; make our own
+		albumID, err = createAlbumRecord(ctx, in, actor)
+		return albumID, false, err
+	}
+
+	albumID, err = createAlbumRecord(ctx, in, actor)
+	finishCreate(key, entry, albumID, err)
+	return albumID, false, err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A direct upload sends the image bytes to S3 rather than through this
+// service. POST /albums/upload-url returns an upload ID and a presigned PUT
+// URL for it; after uploading there, the client confirms the upload with the
+// album's metadata. Images are still stored in MySQL, so confirming reads the
+// object back once over the network to S3, runs the usual upload validation
+// and deletes it. Nothing is recorded until then: a bucket lifecycle rule on
+// S3_UPLOAD_PREFIX should expire objects that are never confirmed. The
+// presigned URL can't limit the object's size; oversized objects are
+// rejected at confirmation.
+
+// uploadURLRequest is the body of POST /albums/upload-url
+type uploadURLRequest struct {
+	Filename string `json:"filename"`
+}
+
+// directUploadLockWait is how long a confirmation waits for another
+// confirmation of the same upload to finish
+const directUploadLockWait = 10 * time.Second
+
+// errUploadBusy is returned when an upload is still being confirmed elsewhere
+var errUploadBusy = errors.New("upload is being confirmed")
+
+// directUploadRoute returns h when S3_BUCKET is set and a 404 handler
+// otherwise, for the same reason as featureRoute
+func directUploadRoute(h gin.HandlerFunc) gin.HandlerFunc {
+	if cfg.S3Bucket != "" {
+		return h
+	}
+	return func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	}
+}
+
+// directUploadKey is the S3 object key for an upload ID
+func directUploadKey(id string) string {
+	return cfg.S3UploadPrefix + id
+}
+
+// CreateUploadURL returns a new upload ID and a presigned S3 PUT URL for its
+// image, valid for S3_UPLOAD_URL_TTL_SECONDS
+func createUploadURL(c *gin.Context) {
+	var req uploadURLRequest
+	if !decodeJSONBody(c, &req) {
+		return
+	}
+	contentType, ok := allowedImageExtensions[strings.ToLower(filepath.Ext(req.Filename))]
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Unsupported image file extension"})
+		return
+	}
+	if !cfg.AllowedImageTypes[contentType] {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Image type " + contentType + " is not accepted"})
+		return
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("Failed to generate upload ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	uploadID := hex.EncodeToString(b[:])
+
+	c.JSON(http.StatusCreated, gin.H{
+		"uploadId":    uploadID,
+		"uploadUrl":   presignS3(http.MethodPut, s3ObjectURL(directUploadKey(uploadID)), cfg.S3UploadURLTTL, time.Now()),
+		"method":      http.MethodPut,
+		"contentType": contentType,
+		"expiresIn":   int(cfg.S3UploadURLTTL.Seconds()),
+	})
+}
+
+// ConfirmUpload creates an album from a direct upload and the metadata in
+// the JSON body, then deletes the uploaded object. Upload IDs have the same
+// form as resumable ones.
+func confirmUpload(c *gin.Context) {
+	id := c.Param("id")
+	if !uploadIDPattern.MatchString(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+
+	var req uploadFinalize
+	if !decodeJSONBody(c, &req) {
+		return
+	}
+	if rejectDeniedArtist(c, req.Artist) {
+		return
+	}
+
+	release, err := lockDirectUpload(c.Request.Context(), id)
+	if errors.Is(err, errUploadBusy) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is already being confirmed"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer release()
+
+	key := directUploadKey(id)
+	image, err := fetchS3Object(c.Request.Context(), key, cfg.MaxImageBytes)
+	if errors.Is(err, errS3ObjectMissing) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	} else if err != nil {
+		log.Printf("Failed to read direct upload %s from S3: %v", id, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read uploaded image"})
+		return
+	}
+	if len(image) > cfg.MaxImageBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image exceeds maximum size"})
+		return
+	}
+	recordUploadSize(c, len(image))
+
+	in, err := newAlbumInput(req.Artist, req.Title, req.Year, filepath.Base(req.Filename), image)
+	if err == nil {
+		err = in.setDetails(req.TrackCount, req.DurationSeconds)
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	albumID, err := createAlbumRecord(c.Request.Context(), in, requestActor(c))
+	if err != nil {
+		respondCreateError(c, err)
+		return
+	}
+	// Should this fail, the object stays until the lifecycle rule expires it
+	// and confirming again would create a second album
+	if err := deleteS3Object(c.Request.Context(), key); err != nil {
+		log.Printf("Failed to delete confirmed upload %s: %v", key, err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"AlbumID": albumID})
+}
+
+// lockDirectUpload takes a MySQL named lock on upload id, so that
+// confirmations of one upload run one at a time on every instance. The lock
+// holds a pool connection until release is called.
+func lockDirectUpload(ctx context.Context, id string) (release func(), err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := "album_upload_" + id
+	var locked int
+	err = conn.QueryRowContext(ctx, "SELECT COALESCE(GET_LOCK(?, ?), 0)", name, int(directUploadLockWait.Seconds())).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if locked != 1 {
+		conn.Close()
+		return nil, errUploadBusy
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", name)
+		conn.Close()
+	}, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeS3 serves one bucket from memory, without checking signatures
+func fakeS3(t *testing.T, objects map[string][]byte) *sync.Map {
+	t.Helper()
+	var deleted sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case http.MethodDelete:
+			deleted.Store(key, true)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+	cfg.S3Bucket, cfg.S3Endpoint, cfg.S3Region = "bucket", srv.URL, "us-east-1"
+	cfg.AWSAccessKeyID, cfg.AWSSecretAccessKey = "key", "secret"
+	return &deleted
+}
+
+func directUploadRoutes(r *gin.Engine) {
+	r.POST("/albums/upload-url", directUploadRoute(createUploadURL))
+	r.POST("/albums/:id/confirm", directUploadRoute(confirmUpload))
+}
+
+func TestCreateUploadURL(t *testing.T) {
+	fakeS3(t, nil)
+
+	w := serve(directUploadRoutes, httptest.NewRequest(http.MethodPost, "/albums/upload-url",
+		strings.NewReader(`{"filename":"cover.png"}`)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusCreated, w.Body)
+	}
+	var resp struct {
+		UploadID  string `json:"uploadId"`
+		UploadURL string `json:"uploadUrl"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !uploadIDPattern.MatchString(resp.UploadID) {
+		t.Errorf("uploadId = %q, want 32 hex digits", resp.UploadID)
+	}
+	if !strings.HasPrefix(resp.UploadURL, cfg.S3Endpoint+"/bucket/"+directUploadKey(resp.UploadID)+"?") ||
+		!strings.Contains(resp.UploadURL, "X-Amz-Signature=") {
+		t.Errorf("uploadUrl %q is not a presigned URL for upload %q", resp.UploadURL, resp.UploadID)
+	}
+}
+
+func TestCreateUploadURLRejectsUnsupportedExtension(t *testing.T) {
+	fakeS3(t, nil)
+
+	w := serve(directUploadRoutes, httptest.NewRequest(http.MethodPost, "/albums/upload-url",
+		strings.NewReader(`{"filename":"cover.txt"}`)))
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestConfirmUpload(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	key := "album-uploads/" + id
+	tests := []struct {
+		name        string
+		objects     map[string][]byte
+		locked      int64
+		wantStatus  int
+		wantDeleted bool
+	}{
+		{"creates the album", map[string][]byte{key: pngImage(t)}, 1, http.StatusCreated, true},
+		{"image not uploaded", nil, 1, http.StatusNotFound, false},
+		{"confirmed concurrently", map[string][]byte{key: pngImage(t)}, 0, http.StatusConflict, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted := fakeS3(t, tt.objects)
+			cfg.S3UploadPrefix = "album-uploads/"
+			fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+				switch {
+				case queryIs(query, "SELECT COALESCE(GET_LOCK"):
+					return fakeResult{rows: [][]driver.Value{{tt.locked}}}, nil
+				case queryIs(query, "INSERT INTO Albums"):
+					return fakeResult{lastID: 11}, nil
+				}
+				return fakeResult{affected: 1}, nil
+			})
+
+			body := `{"artist":"Artist","title":"Title","year":1999,"filename":"cover.png"}`
+			w := serve(directUploadRoutes, httptest.NewRequest(http.MethodPost, "/albums/"+id+"/confirm",
+				strings.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body)
+			}
+			if _, ok := deleted.Load(key); ok != tt.wantDeleted {
+				t.Errorf("object deleted = %v, want %v", ok, tt.wantDeleted)
+			}
+			inserted := false
+			for _, stmt := range fdb.appliedStatements() {
+				inserted = inserted || queryIs(stmt, "INSERT INTO Albums")
+			}
+			if want := tt.wantStatus == http.StatusCreated; inserted != want {
+				t.Errorf("album inserted = %v, want %v", inserted, want)
+			}
+		})
+	}
+}
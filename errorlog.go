@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxCapturedErrorBody bounds how much of an error response is kept for
+// extracting its message
+const maxCapturedErrorBody = 1024
+
+// errorEntry is one error response kept in recentErrors
+type errorEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Status    int       `json:"status"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"requestId"`
+}
+
+// errorRing is a fixed-size, concurrency-safe buffer of the latest errors
+type errorRing struct {
+	mu      sync.Mutex
+	entries []errorEntry
+	next    int
+	full    bool
+}
+
+// recentErrors holds the last ERROR_BUFFER_SIZE error responses
+var recentErrors *errorRing
+
+func newErrorRing(size int) *errorRing {
+	return &errorRing{entries: make([]errorEntry, max(size, 1))}
+}
+
+// Add records e, overwriting the oldest entry once the ring is full
+func (r *errorRing) Add(e errorEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Snapshot returns the recorded errors, newest first
+func (r *errorRing) Snapshot() []errorEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	out := make([]errorEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return out
+}
+
+// requestID tags each request with an ID, reusing a sane X-Request-ID from
+// the client and echoing it in the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID(id) {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		c.Set("requestID", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// validRequestID accepts short IDs of printable ASCII that are safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// errorCaptureWriter keeps the start of the body of error responses
+type errorCaptureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *errorCaptureWriter) Write(b []byte) (int, error) {
+	w.capture(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorCaptureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *errorCaptureWriter) capture(b []byte) {
+	if w.Status() < http.StatusBadRequest {
+		return
+	}
+	if room := maxCapturedErrorBody - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(len(b), room)])
+	}
+}
+
+// recordErrors adds every response with a 4xx or 5xx status to recentErrors
+func recordErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w := &errorCaptureWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		status := w.Status()
+		if status < http.StatusBadRequest {
+			return
+		}
+
+		// Handlers answer with {"error": "..."}; fall back to the status text
+		message := http.StatusText(status)
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(w.body.Bytes(), &body) == nil && body.Error != "" {
+			message = body.Error
+		}
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		recentErrors.Add(errorEntry{
+			Time:      time.Now(),
+			Method:    c.Request.Method,
+			Route:     route,
+			Status:    status,
+			Message:   message,
+			RequestID: c.GetString("requestID"),
+		})
+	}
+}
+
+// ListRecentErrors handles reporting the buffered error responses
+func listRecentErrors(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"errors": recentErrors.Snapshot()})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseHeartbeatInterval is how often an idle stream gets a comment line, so
+// proxies don't close it for inactivity
+const sseHeartbeatInterval = 15 * time.Second
+
+// sseBufferSize is how many events a subscriber may fall behind by before
+// further events are dropped for it
+const sseBufferSize = 64
+
+// albumEvent is a committed change to an album, as pushed to stream clients.
+// Type uses the audit action names.
+type albumEvent struct {
+	Type    string `json:"type"`
+	AlbumID int64  `json:"albumId"`
+	Album   *Album `json:"album,omitempty"`
+}
+
+// albumEvents fans out change events to every open stream. Publishers never
+// block: a subscriber whose buffer is full misses the event.
+var albumEvents = struct {
+	sync.Mutex
+	subs   map[chan albumEvent]struct{}
+	closed bool
+}{subs: make(map[chan albumEvent]struct{})}
+
+// openStreams counts connected stream clients. They are long-lived requests
+// that hold no database connection.
+var openStreams atomic.Int64
+
+// publishAlbumEvent sends ev to every subscriber. Call it only after the
+// change has committed.
+func publishAlbumEvent(ev albumEvent) {
+	albumEvents.Lock()
+	defer albumEvents.Unlock()
+	for ch := range albumEvents.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// subscribeAlbumEvents registers a new subscriber. The channel is closed
+// when the server shuts down.
+func subscribeAlbumEvents() (chan albumEvent, bool) {
+	albumEvents.Lock()
+	defer albumEvents.Unlock()
+	if albumEvents.closed {
+		return nil, false
+	}
+	ch := make(chan albumEvent, sseBufferSize)
+	albumEvents.subs[ch] = struct{}{}
+	return ch, true
+}
+
+// unsubscribeAlbumEvents removes a subscriber
+func unsubscribeAlbumEvents(ch chan albumEvent) {
+	albumEvents.Lock()
+	defer albumEvents.Unlock()
+	if _, ok := albumEvents.subs[ch]; ok {
+		delete(albumEvents.subs, ch)
+		close(ch)
+	}
+}
+
+// closeAlbumEvents ends every stream so that they don't hold up shutdown
+func closeAlbumEvents() {
+	albumEvents.Lock()
+	defer albumEvents.Unlock()
+	albumEvents.closed = true
+	for ch := range albumEvents.subs {
+		delete(albumEvents.subs, ch)
+		close(ch)
+	}
+}
+
+// StreamAlbums pushes album changes to the client as Server-Sent Events
+func streamAlbums(c *gin.Context) {
+	events, ok := subscribeAlbumEvents()
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	defer unsubscribeAlbumEvents(events)
+	openStreams.Add(1)
+	defer openStreams.Add(-1)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// exifOrientationTag is the TIFF tag holding the EXIF orientation
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns the EXIF orientation (1-8) stored in a JPEG's APP1
+// segment, or 1 (upright) when there is none or it can't be parsed
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// Walk the marker segments that precede the image data
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan, end of image
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from IFD0 of a TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// A SHORT value is stored inline in the first bytes of the value field
+		if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+			return v
+		}
+		return 1
+	}
+	return 1
+}
+
+// swapsAxes reports whether an orientation turns the image on its side
+func swapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// applyOrientation returns img rotated and flipped so that it displays
+// upright for the given EXIF orientation. Pixels are copied as raw bytes:
+// *image.Gray and *image.NRGBA keep their type, and anything else, such as
+// the *image.YCbCr a JPEG decodes to, comes back as *image.RGBA.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dr := image.Rect(0, 0, w, h)
+	if swapsAxes(orientation) {
+		dr = image.Rect(0, 0, h, w)
+	}
+
+	var src, dst []byte
+	var srcStride, dstStride, bpp int
+	var out image.Image
+	switch m := img.(type) {
+	case *image.Gray:
+		d := image.NewGray(dr)
+		src, srcStride, dst, dstStride, bpp, out = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, d.Pix, d.Stride, 1, d
+	case *image.NRGBA:
+		d := image.NewNRGBA(dr)
+		src, srcStride, dst, dstStride, bpp, out = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, d.Pix, d.Stride, 4, d
+	default:
+		rgba, ok := img.(*image.RGBA)
+		if !ok {
+			// draw has fast conversions from the common decoded types
+			rgba = image.NewRGBA(image.Rect(0, 0, w, h))
+			draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+		}
+		d := image.NewRGBA(dr)
+		origin := rgba.Bounds().Min
+		src, srcStride, dst, dstStride, bpp, out = rgba.Pix[rgba.PixOffset(origin.X, origin.Y):], rgba.Stride, d.Pix, d.Stride, 4, d
+	}
+
+	// Where source pixel (0, 0) lands in dst, and how far the destination
+	// offset moves for each step right and down in the source
+	var start, xStep, yStep int
+	switch orientation {
+	case 2: // mirrored horizontally
+		start, xStep, yStep = (w-1)*bpp, -bpp, dstStride
+	case 3: // rotated 180
+		start, xStep, yStep = (h-1)*dstStride+(w-1)*bpp, -bpp, -dstStride
+	case 4: // mirrored vertically
+		start, xStep, yStep = (h-1)*dstStride, bpp, -dstStride
+	case 5: // transposed
+		start, xStep, yStep = 0, dstStride, bpp
+	case 6: // needs 90 clockwise
+		start, xStep, yStep = (h-1)*bpp, dstStride, -bpp
+	case 7: // transversed
+		start, xStep, yStep = (w-1)*dstStride+(h-1)*bpp, -dstStride, -bpp
+	case 8: // needs 90 counter-clockwise
+		start, xStep, yStep = (w-1)*dstStride, -dstStride, bpp
+	}
+	for sy := 0; sy < h; sy++ {
+		row := src[sy*srcStride : sy*srcStride+w*bpp]
+		off := start + sy*yStep
+		for sx := 0; sx < len(row); sx += bpp {
+			copy(dst[off:off+bpp], row[sx:sx+bpp])
+			off += xStep
+		}
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// orientPixelwise is the straightforward At/Set form of applyOrientation,
+// to check the byte-copying one against
+func orientPixelwise(img image.Image, orientation int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if swapsAxes(orientation) {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for sy := 0; sy < h; sy++ {
+		for sx := 0; sx < w; sx++ {
+			dx, dy := sx, sy
+			switch orientation {
+			case 2:
+				dx, dy = w-1-sx, sy
+			case 3:
+				dx, dy = w-1-sx, h-1-sy
+			case 4:
+				dx, dy = sx, h-1-sy
+			case 5:
+				dx, dy = sy, sx
+			case 6:
+				dx, dy = h-1-sy, sx
+			case 7:
+				dx, dy = h-1-sy, w-1-sx
+			case 8:
+				dx, dy = sy, w-1-sx
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// Odd, unequal sides and a non-zero origin catch stride and offset slips
+	bounds := image.Rect(2, 3, 7, 10)
+	rgba := image.NewRGBA(bounds)
+	nrgba := image.NewNRGBA(bounds)
+	gray := image.NewGray(bounds)
+	ycbcr := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio420)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA{uint8(x * 30), uint8(y * 20), uint8(x*y + 7), 255}
+			rgba.Set(x, y, c)
+			nrgba.Set(x, y, c)
+			gray.Set(x, y, c)
+		}
+	}
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i * 9)
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i*40), uint8(255-i*40)
+	}
+	// YCbCr comes back as RGBA, so compare against its RGBA conversion
+	ycbcrRGBA := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(ycbcrRGBA, ycbcrRGBA.Bounds(), ycbcr, bounds.Min, draw.Src)
+
+	images := []struct {
+		name      string
+		img, want image.Image
+	}{
+		{"RGBA", rgba, rgba},
+		{"NRGBA", nrgba, nrgba},
+		{"Gray", gray, gray},
+		{"YCbCr", ycbcr, ycbcrRGBA},
+	}
+	for _, tt := range images {
+		for orientation := 1; orientation <= 8; orientation++ {
+			got := applyOrientation(tt.img, orientation)
+			want := orientPixelwise(tt.want, orientation)
+			gb := got.Bounds()
+			if gb.Dx() != want.Bounds().Dx() || gb.Dy() != want.Bounds().Dy() {
+				t.Fatalf("%s orientation %d: bounds %v, want %v", tt.name, orientation, gb, want.Bounds())
+			}
+			for y := 0; y < gb.Dy(); y++ {
+				for x := 0; x < gb.Dx(); x++ {
+					g := color.RGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+					if w := want.RGBAAt(x, y); g != w {
+						t.Fatalf("%s orientation %d: pixel (%d, %d) = %v, want %v", tt.name, orientation, x, y, g, w)
+					}
+				}
+			}
+		}
+	}
+}
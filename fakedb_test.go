@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMain loads the default configuration and the caches main would create,
+// so handlers can run against a fake database
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	loadConfig()
+	initCaches()
+	os.Exit(m.Run())
+}
+
+// fakeResult is what a fake statement returns: rows for queries, an insert
+// ID and affected count for statements
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	lastID   int64
+	affected int64
+}
+
+// fakeDB is a scripted database/sql driver. Every statement is passed to
+// handle; statements run inside a transaction only count as applied once it
+// commits.
+type fakeDB struct {
+	handle func(query string, args []driver.NamedValue) (fakeResult, error)
+
+	mu      sync.Mutex
+	applied []string
+	events  []string
+}
+
+// record notes an event such as "begin" or "rollback"
+func (f *fakeDB) record(event string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+}
+
+// appliedStatements returns the statements that took effect
+func (f *fakeDB) appliedStatements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.applied...)
+}
+
+// hasEvent reports whether event was recorded
+func (f *fakeDB) hasEvent(event string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+var fakeDBs sync.Map
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	f, ok := fakeDBs.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return &fakeConn{db: f.(*fakeDB)}, nil
+}
+
+type fakeConn struct {
+	db      *fakeDB
+	pending []string
+	inTx    bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+// Ping passes "PING" to the handler, so tests can fail it
+func (c *fakeConn) Ping(ctx context.Context) error {
+	_, err := c.db.handle("PING", nil)
+	return err
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	c.db.record("begin")
+	c.inTx, c.pending = true, nil
+	return fakeTx{c}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.db.handle(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if c.inTx {
+		c.pending = append(c.pending, query)
+	} else {
+		c.db.mu.Lock()
+		c.db.applied = append(c.db.applied, query)
+		c.db.mu.Unlock()
+	}
+	affected := res.affected
+	if affected == 0 && res.lastID != 0 {
+		affected = 1
+	}
+	return fakeExecResult{lastID: res.lastID, affected: affected}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.db.handle(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: res.columns, rows: res.rows}, nil
+}
+
+type fakeTx struct{ conn *fakeConn }
+
+func (t fakeTx) Commit() error {
+	t.conn.db.record("commit")
+	t.conn.db.mu.Lock()
+	t.conn.db.applied = append(t.conn.db.applied, t.conn.pending...)
+	t.conn.db.mu.Unlock()
+	t.conn.inTx, t.conn.pending = false, nil
+	return nil
+}
+
+func (t fakeTx) Rollback() error {
+	t.conn.db.record("rollback")
+	t.conn.inTx, t.conn.pending = false, nil
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type fakeExecResult struct{ lastID, affected int64 }
+
+func (r fakeExecResult) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r fakeExecResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if r.columns == nil && len(r.rows) > 0 {
+		r.columns = make([]string, len(r.rows[0]))
+	}
+	return r.columns
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// useFakeDB points the primary and read pools at a fake database driven by
+// handle for the rest of the test
+func useFakeDB(t *testing.T, handle func(query string, args []driver.NamedValue) (fakeResult, error)) *fakeDB {
+	t.Helper()
+	f := &fakeDB{handle: handle}
+	fakeDBs.Store(t.Name(), f)
+	pool, err := sql.Open("fakedb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB, prevReadDB, prevTokens := db, readDB, retryTokens
+	db, readDB, retryTokens = pool, pool, newTokenBucket(0, 0)
+	t.Cleanup(func() {
+		pool.Close()
+		db, readDB, retryTokens = prevDB, prevReadDB, prevTokens
+		fakeDBs.Delete(t.Name())
+	})
+	return f
+}
+
+// queryIs reports whether query starts with prefix, ignoring whitespace
+// differences
+func queryIs(query, prefix string) bool {
+	return strings.HasPrefix(strings.Join(strings.Fields(query), " "), prefix)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultFeatures lists the optional endpoint groups and whether each is on
+// when its FEATURE_<NAME> variable is unset
+var defaultFeatures = map[string]bool{
+	"search": true,
+	"import": true,
+}
+
+// loadFeatures resolves every feature flag from the environment
+func loadFeatures() map[string]bool {
+	features := make(map[string]bool, len(defaultFeatures))
+	for name, def := range defaultFeatures {
+		features[name] = envBool("FEATURE_"+strings.ToUpper(name), def)
+	}
+	return features
+}
+
+// logFeatures reports the enabled features at startup
+func logFeatures() {
+	var enabled []string
+	for name, on := range cfg.Features {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	log.Printf("Enabled features: %s", strings.Join(enabled, ", "))
+}
+
+// featureRoute returns h when feature is enabled and a 404 handler otherwise.
+// Registering the 404 handler, rather than skipping the route, keeps requests
+// for a disabled path from falling through to a wildcard like /albums/:id.
+func featureRoute(feature string, h gin.HandlerFunc) gin.HandlerFunc {
+	if cfg.Features[feature] {
+		return h
+	}
+	return func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Fuzzy years, accepted with ALLOW_FUZZY_YEAR, are partial or approximate
+// dates such as "199X", "1980s" or "c. 1985". The text is kept as given in
+// year_text, and year holds the earliest year it can mean: 1990 for "199X",
+// 1900 for "19XX", 1980 for "1980s" and 1985 for "c. 1985". Fuzzy years
+// therefore sort and filter together with that exact year, so "199X" lands
+// among the albums from 1990, and albums sharing a year keep their usual
+// order by ID.
+
+// maxYearTextLength is the size of the year_text column
+const maxYearTextLength = 32
+
+var (
+	// yearWildcard matches a year with its trailing digits replaced by X or ?
+	yearWildcard = regexp.MustCompile(`^(\d{2,3})([x?]+)$`)
+	// yearDecade matches a decade such as 1980s or 1980's
+	yearDecade = regexp.MustCompile(`^(\d{3}0)'?s$`)
+	// yearApproximate matches a year with an approximation marker before or
+	// after it: c. 1985, ca 1985, circa 1985, ~1985, 1985?
+	yearApproximate = regexp.MustCompile(`^(?:(?:c|ca|circa)\.?\s*|~\s*)?(\d{4})\??$`)
+)
+
+// parseFuzzyYear derives the numeric year for a fuzzy year, reporting false
+// when s isn't one of the recognized forms
+func parseFuzzyYear(s string) (int, bool) {
+	s = strings.ToLower(collapseSpaces(s))
+	var digits string
+	if m := yearWildcard.FindStringSubmatch(s); m != nil && len(m[1])+len(m[2]) == 4 {
+		digits = m[1] + strings.Repeat("0", len(m[2]))
+	} else if m := yearDecade.FindStringSubmatch(s); m != nil {
+		digits = m[1]
+	} else if m := yearApproximate.FindStringSubmatch(s); m != nil {
+		digits = m[1]
+	} else {
+		return 0, false
+	}
+	year, err := strconv.Atoi(digits)
+	if err != nil || year <= 0 {
+		return 0, false
+	}
+	return year, true
+}
+
+// parseFormYear reads the year form value. An integer is an exact year and
+// yields no text; with ALLOW_FUZZY_YEAR a fuzzy year is also accepted and
+// returned alongside the year derived from it.
+func parseFormYear(s string) (year int, text *string, err error) {
+	year, err = strconv.Atoi(s)
+	if err == nil && year > 0 {
+		return year, nil, nil
+	}
+	if !cfg.AllowFuzzyYear {
+		return 0, nil, &validationError{"Year must be a positive integer"}
+	}
+	clean := collapseSpaces(s)
+	year, ok := parseFuzzyYear(clean)
+	if !ok || len(clean) > maxYearTextLength {
+		return 0, nil, &validationError{`Year must be a positive integer or an approximate year such as "199X", "1980s" or "c. 1985"`}
+	}
+	return year, &clean, nil
+}
+
+// checkYearText validates year text that arrives alongside its numeric year,
+// as in an album bundle. It must be a fuzzy year that derives year; blank
+// text is treated as absent.
+func checkYearText(year int, text *string) (*string, error) {
+	if text == nil || strings.TrimSpace(*text) == "" {
+		return nil, nil
+	}
+	clean := collapseSpaces(*text)
+	derived, ok := parseFuzzyYear(clean)
+	if !ok || len(clean) > maxYearTextLength || derived != year {
+		return nil, &validationError{"yearText must be an approximate year matching year"}
+	}
+	return &clean, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startupRetryAfter is the Retry-After sent while the service starts up
+const startupRetryAfter = "5"
+
+// ready is set once startup has finished: the database is connected and
+// migrated and the pool warmed up
+var ready atomic.Bool
+
+// markReady opens the service to traffic
+func markReady() {
+	ready.Store(true)
+	log.Printf("Startup complete, accepting traffic")
+}
+
+// rejectUntilReady answers 503 to everything but the health routes until
+// markReady is called, so load balancers and clients retry instead of
+// reaching handlers whose database isn't there yet
+func rejectUntilReady() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ready.Load() && c.Request.URL.Path != "/health" && c.Request.URL.Path != "/health/ready" {
+			c.Header("Retry-After", startupRetryAfter)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Service is starting, please retry"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// readinessTimeout bounds the combined duration of all readiness checks
+const readinessTimeout = 2 * time.Second
+
+// healthCheck probes a single dependency. A failing critical check marks the
+// whole service unavailable; a failing non-critical one only degrades it. A
+// check may also return details, reported whether or not it failed.
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) (details any, err error)
+}
+
+// healthChecks lists every dependency reported by /health/ready
+var healthChecks = []healthCheck{
+	{
+		name:     "db",
+		critical: true,
+		check: func(ctx context.Context) (any, error) {
+			return nil, db.PingContext(ctx)
+		},
+	},
+	{
+		name:     "cache",
+		critical: false,
+		check:    checkCaches,
+	},
+}
+
+// initHealthChecks adds the checks that depend on configuration
+func initHealthChecks() {
+	// Only direct uploads go through S3; stored images stay readable
+	// without it
+	if cfg.S3Bucket != "" {
+		healthChecks = append(healthChecks, healthCheck{
+			name:     "storage",
+			critical: false,
+			check: func(ctx context.Context) (any, error) {
+				return nil, headS3Bucket(ctx)
+			},
+		})
+	}
+	if cfg.MaxReplicaLag > 0 {
+		healthChecks = append(healthChecks, healthCheck{
+			name:     "replication",
+			critical: cfg.ReplicaLagCritical,
+			check:    checkReplicaLag,
+		})
+	}
+}
+
+// checkResult is the outcome of one healthCheck
+type checkResult struct {
+	name    string
+	status  string
+	details any
+}
+
+// ReadinessHandler runs all health checks concurrently and reports each one
+func readinessHandler(c *gin.Context) {
+	if !ready.Load() {
+		c.Header("Retry-After", startupRetryAfter)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "starting"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	// Buffered so checks that finish after the deadline never block
+	results := make(chan checkResult, len(healthChecks))
+	for _, hc := range healthChecks {
+		go func(hc healthCheck) {
+			status := "ok"
+			details, err := hc.check(ctx)
+			if err != nil {
+				log.Printf("Health check %s failed: %v", hc.name, err)
+				status = failureStatus(hc)
+			}
+			results <- checkResult{name: hc.name, status: status, details: details}
+		}(hc)
+	}
+
+	checks := make(map[string]string, len(healthChecks))
+	details := make(map[string]any)
+	for range healthChecks {
+		select {
+		case r := <-results:
+			checks[r.name] = r.status
+			if r.details != nil {
+				details[r.name] = r.details
+			}
+		case <-ctx.Done():
+		}
+	}
+
+	// Anything still missing ran past the deadline
+	overall, code := "ok", http.StatusOK
+	for _, hc := range healthChecks {
+		status, ok := checks[hc.name]
+		if !ok {
+			status = failureStatus(hc)
+			checks[hc.name] = status
+		}
+		if status == "ok" {
+			continue
+		}
+		if hc.critical {
+			overall, code = "unhealthy", http.StatusServiceUnavailable
+		} else if overall == "ok" {
+			overall = "degraded"
+		}
+	}
+
+	body := gin.H{"status": overall, "checks": checks}
+	if len(details) > 0 {
+		body["details"] = details
+	}
+	c.JSON(code, body)
+}
+
+// failureStatus reports how a failure of hc is surfaced
+func failureStatus(hc healthCheck) string {
+	if hc.critical {
+		return "unhealthy"
+	}
+	return "degraded"
+}
+
+// cacheStatus is the entry count and capacity of one in-process cache
+type cacheStatus struct {
+	Entries  int `json:"entries"`
+	Capacity int `json:"capacity"`
+}
+
+// checkCaches reports how full the image caches are. They live in this
+// process, so the check only fails if initCaches hasn't run.
+func checkCaches(ctx context.Context) (any, error) {
+	if thumbnailCache == nil || convertedCache == nil || cardCache == nil {
+		return nil, errors.New("caches are not initialized")
+	}
+	return map[string]cacheStatus{
+		"thumbnail": {thumbnailCache.Len(), cfg.ThumbnailCacheSize},
+		"converted": {convertedCache.Len(), cfg.ConvertedCacheSize},
+		"card":      {cardCache.Len(), cfg.CardCacheSize},
+	}, nil
+}
+
+// replicaStatus is the replication check's report
+type replicaStatus struct {
+	Replica    bool   `json:"replica"`
+	LagSeconds *int64 `json:"lagSeconds,omitempty"`
+}
+
+// checkReplicaLag fails when the read pool's server is a replica lagging more than
+// MAX_REPLICA_LAG_SECONDS behind its source, or one whose replication has
+// stopped. A server that isn't a replica passes.
+func checkReplicaLag(ctx context.Context) (any, error) {
+	// SHOW REPLICA STATUS needs MySQL 8.0.22; older servers only know the
+	// SLAVE spelling, which names the lag column after the master
+	lag, found, err := showReplicaStatus(ctx, "SHOW REPLICA STATUS", "Seconds_Behind_Source")
+	if isMySQLError(err, errSyntax) {
+		lag, found, err = showReplicaStatus(ctx, "SHOW SLAVE STATUS", "Seconds_Behind_Master")
+	}
+	if err != nil {
+		return nil, err
+	}
+	status := replicaStatus{Replica: found}
+	if !found {
+		return status, nil
+	}
+	if !lag.Valid {
+		return status, errors.New("replication is not running")
+	}
+	status.LagSeconds = &lag.Int64
+	if lag.Int64 > int64(cfg.MaxReplicaLag.Seconds()) {
+		return status, fmt.Errorf("replica is %ds behind its source", lag.Int64)
+	}
+	return status, nil
+}
+
+// showReplicaStatus runs a replica status statement and reads the lag
+// column. found is false when the server reports no replication channel.
+func showReplicaStatus(ctx context.Context, stmt, lagColumn string) (lag sql.NullInt64, found bool, err error) {
+	rows, err := readDB.QueryContext(ctx, stmt)
+	if err != nil {
+		return lag, false, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return lag, false, err
+	}
+	if !rows.Next() {
+		return lag, false, rows.Err()
+	}
+	dest := make([]any, len(columns))
+	for i, name := range columns {
+		if name == lagColumn {
+			dest[i] = &lag
+		} else {
+			dest[i] = new(sql.RawBytes)
+		}
+	}
+	return lag, true, rows.Scan(dest...)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadinessReportsStorage(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		s3Status   int
+		wantStatus string
+	}{
+		{"bucket reachable", http.StatusOK, "ok"},
+		{"bucket forbidden", http.StatusForbidden, "degraded"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var checkedPath string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				checkedPath = r.Method + " " + r.URL.Path
+				w.WriteHeader(tt.s3Status)
+			}))
+			defer srv.Close()
+			prevCfg, prevChecks, prevReady := cfg, healthChecks, ready.Load()
+			t.Cleanup(func() { cfg, healthChecks = prevCfg, prevChecks; ready.Store(prevReady) })
+			cfg.S3Bucket, cfg.S3Endpoint, cfg.MaxReplicaLag = "bucket", srv.URL, 0
+			cfg.AWSAccessKeyID, cfg.AWSSecretAccessKey = "key", "secret"
+			initHealthChecks()
+			ready.Store(true)
+			useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+				return fakeResult{}, nil
+			})
+
+			w := serve(func(r *gin.Engine) { r.GET("/health/ready", readinessHandler) },
+				httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+			var body struct {
+				Status string
+				Checks map[string]string
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusOK || body.Status != tt.wantStatus {
+				t.Errorf("readiness = %d %q, want 200 %q (body %s)", w.Code, body.Status, tt.wantStatus, w.Body)
+			}
+			for _, name := range []string{"db", "storage", "cache"} {
+				if _, ok := body.Checks[name]; !ok {
+					t.Errorf("no %s check in %v", name, body.Checks)
+				}
+			}
+			if checkedPath != "HEAD /bucket" {
+				t.Errorf("storage check sent %q, want HEAD /bucket", checkedPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailSpec identifies the current thumbnail settings. It is stored next
+// to each thumbnail so stale ones can be found after the settings change.
+func thumbnailSpec() string {
+	return fmt.Sprintf("w%d-q%d", cfg.ThumbnailWidth, cfg.ThumbnailQuality)
+}
+
+// decodedFormatTypes maps the format names image.DecodeConfig reports to
+// content types
+var decodedFormatTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// detectImageType is http.DetectContentType with a fallback for images the
+// sniffer doesn't recognize, such as some WebP variants: when sniffing only
+// finds application/octet-stream, the registered image decoders are asked to
+// identify the header instead
+func detectImageType(data []byte) string {
+	detected := http.DetectContentType(data)
+	if detected != "application/octet-stream" {
+		return detected
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		if contentType, ok := decodedFormatTypes[format]; ok {
+			return contentType
+		}
+	}
+	return detected
+}
+
+// errTooManyPixels is returned for images whose declared dimensions exceed
+// MAX_IMAGE_PIXELS
+var errTooManyPixels = errors.New("image exceeds maximum pixel count")
+
+// checkImagePixels reads only the image header and rejects images that would
+// decode to more than MAX_IMAGE_PIXELS. A few kilobytes of compressed data can
+// declare dimensions that take gigabytes to decode.
+func checkImagePixels(config image.Config) error {
+	if cfg.MaxImagePixels > 0 && int64(config.Width)*int64(config.Height) > cfg.MaxImagePixels {
+		return errTooManyPixels
+	}
+	return nil
+}
+
+// decodeImage is image.Decode behind the MAX_IMAGE_PIXELS guard
+func decodeImage(data []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkImagePixels(config); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// makeThumbnail scales an encoded image down to width pixels wide, keeping
+// its aspect ratio, and re-encodes it as a JPEG of the given quality. JPEGs
+// carrying an EXIF orientation are turned upright first.
+func makeThumbnail(data []byte, width, quality int) ([]byte, error) {
+	src, format, err := decodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	return encodeThumbnail(src, imageOrientation(data, format), width, quality)
+}
+
+// imageOrientation is the EXIF orientation of an encoded image, 1 (upright)
+// for anything but a JPEG
+func imageOrientation(data []byte, format string) int {
+	if format == "jpeg" {
+		return jpegOrientation(data)
+	}
+	return 1
+}
+
+// encodeThumbnail is makeThumbnail for an already decoded image
+func encodeThumbnail(src image.Image, orientation, width, quality int) ([]byte, error) {
+	// Size the thumbnail by its upright dimensions, never upscaling
+	b := src.Bounds()
+	uprightW, uprightH := b.Dx(), b.Dy()
+	if swapsAxes(orientation) {
+		uprightW, uprightH = uprightH, uprightW
+	}
+	if uprightW < width {
+		width = uprightW
+	}
+	height := max(uprightH*width/uprightW, 1)
+
+	// Scale in the stored orientation and rotate the small result, which is
+	// far cheaper than rotating the full-size image
+	scaledW, scaledH := width, height
+	if swapsAxes(orientation) {
+		scaledW, scaledH = height, width
+	}
+
+	// JPEG has no alpha channel, so flatten transparency onto white
+	dst := image.NewRGBA(image.Rect(0, 0, scaledW, scaledH))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, applyOrientation(dst, orientation), &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// JPEG qualities recompressJPEG tries, from the first down in steps until the
+// result fits or RECOMPRESS_MIN_QUALITY is reached
+const (
+	recompressStartQuality = 90
+	recompressQualityStep  = 5
+)
+
+// recompressJPEG re-encodes an oversized JPEG at lower qualities until it is
+// no larger than RECOMPRESS_ABOVE_BYTES, keeping the smallest attempt when
+// even RECOMPRESS_MIN_QUALITY doesn't get there. The pixels are written
+// upright, so the picture and its displayed dimensions are unchanged even
+// though the EXIF orientation, like the rest of the metadata, is dropped. It
+// reports false when data is already small enough or no attempt beat it.
+func recompressJPEG(data []byte, src image.Image, orientation int) ([]byte, bool) {
+	if cfg.RecompressAbove <= 0 || len(data) <= cfg.RecompressAbove {
+		return nil, false
+	}
+	upright := applyOrientation(src, orientation)
+	best := data
+	for quality := recompressStartQuality; quality >= cfg.RecompressFloor; quality -= recompressQualityStep {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, upright, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, false
+		}
+		if buf.Len() < len(best) {
+			best = buf.Bytes()
+		}
+		if len(best) <= cfg.RecompressAbove {
+			break
+		}
+	}
+	if len(best) == len(data) {
+		return nil, false
+	}
+	return best, true
+}
+
+// convertFormats maps each format an image can be requested in to its
+// content type
+var convertFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// errNoEncoder is returned for a format that can be served but not produced.
+// x/image only decodes WebP, so a WebP image is only served when it is stored
+// as one.
+var errNoEncoder = errors.New("no encoder for format")
+
+// convertedJPEGQuality is the quality used when converting to JPEG
+const convertedJPEGQuality = 90
+
+// convertImage re-encodes an image in the given format, one of
+// convertFormats. Transparency is flattened onto white for JPEG, and WebP,
+// which can't be produced, returns errNoEncoder.
+func convertImage(data []byte, format string) ([]byte, error) {
+	if format == "webp" {
+		return nil, errNoEncoder
+	}
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		dst := image.NewRGBA(src.Bounds())
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: convertedJPEGQuality})
+	case "png":
+		err = png.Encode(&buf, src)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encode %s: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// imageHash is the hex SHA-256 of an image's bytes, stored as image_hash
+func imageHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// imageETag is the strong entity tag for a stored image: its quoted hash,
+// computed from the bytes for rows the backfill hasn't reached yet
+func imageETag(data []byte, hash sql.NullString) string {
+	if !hash.Valid {
+		hash.String = imageHash(data)
+	}
+	return strconv.Quote(hash.String)
+}
+
+// ifMatchAccepts reports whether an If-Match header value lets a write go
+// ahead against an image tagged etag. Weak tags never match, per RFC 9110.
+func ifMatchAccepts(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
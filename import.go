@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// importBatchSize is how many archive entries are inserted per transaction
+const importBatchSize = 50
+
+// importResult reports what happened to one archive entry
+type importResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"` // created, skipped or failed
+	AlbumID int64  `json:"albumId,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ImportAlbumsZip creates one album per image in a ZIP archive sent as the
+// request body. Each entry is named "artist-title-year.ext": the artist runs
+// up to the first dash and the year follows the last, so titles may contain
+// dashes but artists may not. Non-image entries are skipped and invalid ones
+// reported, without failing the rest of the import.
+func importAlbumsZip(c *gin.Context) {
+	archive, cleanup, ok := readImportArchive(c)
+	if !ok {
+		return
+	}
+	defer cleanup()
+
+	actor := requestActor(c)
+	results := make([]importResult, 0, len(archive.File))
+	var batch []*albumInput
+	var batchIdx []int
+
+	// flush inserts the pending batch in one transaction, failing every entry
+	// in it if the transaction can't be committed
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ids := make([]int64, len(batch))
+		overQuota := make([]bool, len(batch))
+		err := withTx(c.Request.Context(), func(tx *sql.Tx) error {
+			for i, in := range batch {
+				// Reset on every attempt, since withTx may run this again
+				overQuota[i] = false
+				if err := checkArtistQuota(tx, in); errors.Is(err, errArtistQuota) {
+					overQuota[i] = true
+					continue
+				} else if err != nil {
+					return fmt.Errorf("quota %s: %w", in.filename, err)
+				}
+				id, err := insertAlbum(tx, in)
+				if err != nil {
+					return fmt.Errorf("insert %s: %w", in.filename, err)
+				}
+				if err := writeAudit(tx, id, auditCreate, actor, in.auditDetails()); err != nil {
+					return fmt.Errorf("audit %s: %w", in.filename, err)
+				}
+				ids[i] = id
+			}
+			return nil
+		})
+		for i, idx := range batchIdx {
+			if err != nil {
+				results[idx].Status, results[idx].Error = "failed", "Failed to insert album"
+				continue
+			}
+			if overQuota[i] {
+				results[idx].Status, results[idx].Error = "failed", "Artist has reached the album limit"
+				continue
+			}
+			results[idx].Status, results[idx].AlbumID = "created", ids[i]
+			publishAlbumEvent(albumEvent{Type: auditCreate, AlbumID: ids[i], Album: batch[i].summary(ids[i])})
+		}
+		if err != nil {
+			log.Printf("ZIP import batch failed: %v", err)
+		}
+		batch, batchIdx = batch[:0], batchIdx[:0]
+	}
+
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		results = append(results, importResult{Name: f.Name})
+		r := &results[len(results)-1]
+
+		in, skip, err := readImportEntry(f)
+		switch {
+		case skip:
+			r.Status = "skipped"
+			r.Error = "Not an image"
+		case err != nil:
+			if errors.Is(err, errArtistDenied) {
+				log.Printf("Rejected import entry %q for a denylisted artist from %s (request %s)",
+					f.Name, actor, c.GetString("requestID"))
+			}
+			r.Status = "failed"
+			r.Error = err.Error()
+		default:
+			in.prepareThumbnail()
+			batch = append(batch, in)
+			batchIdx = append(batchIdx, len(results)-1)
+			if len(batch) == importBatchSize {
+				flush()
+			}
+		}
+	}
+	flush()
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// importEntryError is a problem found by validateImportZip
+type importEntryError struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// ValidateImportZip checks every entry of an archive the way importAlbumsZip
+// would, without inserting anything, and lists the entries that would fail.
+// Indexes count the archive's file entries, matching the import's results.
+func validateImportZip(c *gin.Context) {
+	archive, cleanup, ok := readImportArchive(c)
+	if !ok {
+		return
+	}
+	defer cleanup()
+
+	errs := []importEntryError{}
+	entries, valid, skipped := 0, 0, 0
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		_, skip, err := readImportEntry(f)
+		switch {
+		case skip:
+			skipped++
+		case err != nil:
+			errs = append(errs, importEntryError{Index: entries, Name: f.Name, Error: err.Error()})
+		default:
+			valid++
+		}
+		entries++
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": len(errs) == 0, "entries": entries, "importable": valid,
+		"skipped": skipped, "errors": errs})
+}
+
+// readImportArchive spools the request body to a temporary file and opens it
+// as a ZIP archive, since archive/zip needs random access. On failure it
+// writes the response and returns false; otherwise the caller must call
+// cleanup when done with the archive.
+func readImportArchive(c *gin.Context) (archive *zip.Reader, cleanup func(), ok bool) {
+	tmp, err := os.CreateTemp("", "albums-import-*.zip")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to buffer archive"})
+		return nil, nil, false
+	}
+	cleanup = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	size, err := io.Copy(tmp, c.Request.Body)
+	if isBodyTooLarge(err) {
+		cleanup()
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return nil, nil, false
+	} else if err != nil {
+		cleanup()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read archive"})
+		return nil, nil, false
+	}
+
+	archive, err = zip.NewReader(tmp, size)
+	if err != nil {
+		cleanup()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ZIP archive"})
+		return nil, nil, false
+	}
+	return archive, cleanup, true
+}
+
+// readImportEntry parses and validates a single archive entry. Entries that
+// aren't images at all come back with skip set. The thumbnail is left for
+// the caller to render.
+func readImportEntry(f *zip.File) (in *albumInput, skip bool, err error) {
+	filename := path.Base(f.Name)
+	ext := path.Ext(filename)
+	if _, ok := allowedImageExtensions[strings.ToLower(ext)]; !ok || strings.HasPrefix(filename, ".") {
+		return nil, true, nil
+	}
+
+	artist, title, year, err := parseImportName(strings.TrimSuffix(filename, ext))
+	if err != nil {
+		return nil, false, err
+	}
+	if cfg.ArtistDenylist.denies(artist) {
+		return nil, false, errArtistDenied
+	}
+
+	if f.UncompressedSize64 > uint64(cfg.MaxImageBytes) {
+		return nil, false, &validationError{"Image exceeds maximum size"}
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, false, &validationError{"Failed to open entry"}
+	}
+	defer rc.Close()
+
+	// The declared size can lie, so enforce the cap while reading too
+	image, err := io.ReadAll(io.LimitReader(rc, int64(cfg.MaxImageBytes)+1))
+	if err != nil {
+		return nil, false, &validationError{"Failed to read entry"}
+	}
+	if len(image) > cfg.MaxImageBytes {
+		return nil, false, &validationError{"Image exceeds maximum size"}
+	}
+
+	in, err = checkAlbumInput(artist, title, year, filename, image)
+	return in, false, err
+}
+
+// parseImportName splits "artist-title-year" into its parts
+func parseImportName(name string) (artist, title string, year int, err error) {
+	first := strings.Index(name, "-")
+	last := strings.LastIndex(name, "-")
+	if first < 0 || first == last {
+		return "", "", 0, &validationError{"Filename must be artist-title-year"}
+	}
+
+	artist = cleanField(name[:first])
+	title = cleanField(name[first+1 : last])
+	if artist == "" || title == "" {
+		return "", "", 0, &validationError{"Artist and title are required"}
+	}
+	year, err = strconv.Atoi(strings.TrimSpace(name[last+1:]))
+	if err != nil || year <= 0 {
+		return "", "", 0, &validationError{"Year must be a positive integer"}
+	}
+	return artist, title, year, nil
+}
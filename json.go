@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newJSONDecoder reads a request body, rejecting unknown fields when
+// STRICT_JSON is set so that typos like "titel" don't go unnoticed
+func newJSONDecoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if cfg.StrictJSON {
+		dec.DisallowUnknownFields()
+	}
+	return dec
+}
+
+// unknownJSONField returns the field named by an error from a strict decoder
+func unknownJSONField(err error) (string, bool) {
+	// encoding/json has no typed error for this case
+	field, ok := strings.CutPrefix(err.Error(), "json: unknown field ")
+	return field, ok
+}
+
+// decodeJSONBody decodes the request body into dst, writing the error
+// response and returning false when it can't
+func decodeJSONBody(c *gin.Context, dst any) bool {
+	err := newJSONDecoder(c.Request.Body).Decode(dst)
+	if err == nil {
+		return true
+	}
+	if isBodyTooLarge(err) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+	} else if field, ok := unknownJSONField(err); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown field " + field})
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+	}
+	return false
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// countCacheTTL is how long a COUNT(*) result is reused across list calls
+const countCacheTTL = 5 * time.Second
+
+// albumSummaryColumns are the columns selected for list responses, in the
+// order scanAlbumSummaries expects. Images are never included.
+const albumSummaryColumns = "id, artist, title, year, year_text, filename, version, track_count, duration_seconds, " +
+	"upc, isrc"
+
+// pagination describes the page returned by a list endpoint
+type pagination struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	Total  int `json:"total"`
+
+	// truncated is set by capResultRows when Total was cut to MAX_RESULT_ROWS
+	truncated bool
+}
+
+// rowLimit is how many rows to fetch for the page: Limit, or fewer when the
+// page reaches past a truncated result
+func (p pagination) rowLimit() int {
+	if p.truncated {
+		return max(min(p.Limit, p.Total-p.Offset), 0)
+	}
+	return p.Limit
+}
+
+// countCache remembers recent COUNT(*) results keyed by query and arguments
+var countCache = struct {
+	sync.Mutex
+	entries map[string]countEntry
+}{entries: make(map[string]countEntry)}
+
+type countEntry struct {
+	total   int
+	expires time.Time
+}
+
+// parsePagination reads the limit and offset query parameters. Without a
+// limit, pages hold DEFAULT_PAGE_SIZE albums; clients may ask for up to
+// MAX_PAGE_SIZE.
+func parsePagination(c *gin.Context) (pagination, bool) {
+	p := pagination{Limit: cfg.DefaultPageSize}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > cfg.MaxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(cfg.MaxPageSize)})
+			return p, false
+		}
+		p.Limit = n
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return p, false
+		}
+		p.Offset = n
+	}
+	return p, true
+}
+
+// capResultRows applies MAX_RESULT_ROWS once page.Total holds the number of
+// rows the query matches. When truncating, only the first MAX_RESULT_ROWS of
+// them can be paged through and Total reports the cap.
+func capResultRows(c *gin.Context, page *pagination) bool {
+	if page.Total <= cfg.MaxResultRows {
+		return true
+	}
+	if !allowOversizedResult(c) {
+		return false
+	}
+	page.Total, page.truncated = cfg.MaxResultRows, true
+	return true
+}
+
+// allowOversizedResult handles a response that would carry more than
+// MAX_RESULT_ROWS rows. In truncate mode it flags the response with
+// X-Result-Truncated and reports true, leaving the caller to cut the result
+// down; in reject mode it writes a 400 asking for a narrower query.
+func allowOversizedResult(c *gin.Context) bool {
+	if cfg.RejectOversizedResults {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf(
+			"Query matches more than %d rows; narrow it or page through the results", cfg.MaxResultRows)})
+		return false
+	}
+	c.Header("X-Result-Truncated", "true")
+	return true
+}
+
+// countAlbums runs a COUNT(*) query, serving repeated calls from countCache
+// for countCacheTTL
+func countAlbums(ctx context.Context, query string, args ...any) (int, error) {
+	key := query + "\x00" + sqlArgsKey(args)
+
+	countCache.Lock()
+	entry, ok := countCache.entries[key]
+	countCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.total, nil
+	}
+
+	var total int
+	if err := replicaQueryRow(ctx, query, args...).Scan(&total); err != nil {
+		return 0, err
+	}
+
+	countCache.Lock()
+	countCache.entries[key] = countEntry{total: total, expires: time.Now().Add(countCacheTTL)}
+	// Drop expired entries so distinct filters don't accumulate forever
+	for k, e := range countCache.entries {
+		if time.Now().After(e.expires) {
+			delete(countCache.entries, k)
+		}
+	}
+	countCache.Unlock()
+
+	return total, nil
+}
+
+// sqlArgsKey renders query arguments for use in a cache key
+func sqlArgsKey(args []any) string {
+	var key []byte
+	for _, a := range args {
+		key = append(key, '\x1f')
+		switch v := a.(type) {
+		case string:
+			key = append(key, v...)
+		case int:
+			key = strconv.AppendInt(key, int64(v), 10)
+		case int64:
+			key = strconv.AppendInt(key, v, 10)
+		default:
+			key = append(key, '?')
+		}
+	}
+	return string(key)
+}
+
+// summaryDest returns scan destinations matching albumSummaryColumns
+func (a *Album) summaryDest() []any {
+	return []any{&a.ID, &a.Artist, &a.Title, &a.Year, &a.YearText, &a.Filename, &a.Version, &a.TrackCount,
+		&a.DurationSeconds, &a.UPC, &a.ISRC}
+}
+
+// scanAlbumSummaries reads rows selected with albumSummaryColumns
+func scanAlbumSummaries(rows *sql.Rows) ([]Album, error) {
+	defer rows.Close()
+
+	// Encode an empty page as [] rather than null
+	albums := []Album{}
+	for rows.Next() {
+		var a Album
+		if err := rows.Scan(a.summaryDest()...); err != nil {
+			return nil, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// Response format versions. v1 is the legacy bare array; v2 wraps list
+// results in a pagination envelope.
+const (
+	responseV1     = 1
+	responseV2     = 2
+	latestResponse = responseV2
+)
+
+// responseVersion picks the response format from the Accept header:
+// application/vnd.albums.vN+json selects version N, plain application/json
+// selects v1, and anything else, including no header, gets the latest
+func responseVersion(c *gin.Context) int {
+	for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/vnd.albums.v1+json", "application/json":
+			return responseV1
+		case "application/vnd.albums.v2+json":
+			return responseV2
+		}
+	}
+	return latestResponse
+}
+
+// respondPage writes a page of albums in the format the client negotiated:
+// wrapped in a pagination envelope for v2, or as a bare array for v1. The
+// older envelope=false parameter still forces a bare array.
+func respondPage(c *gin.Context, albums []Album, page pagination) {
+	c.Header("Vary", "Accept")
+	c.Header("Link", paginationLinks(c, page))
+	if c.Query("envelope") == "false" || responseVersion(c) == responseV1 {
+		c.JSON(http.StatusOK, albums)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": albums, "pagination": page})
+}
+
+// paginationLinks builds an RFC 8288 Link header pointing at the first,
+// previous, next and last pages, keeping the request's other query parameters
+func paginationLinks(c *gin.Context, page pagination) string {
+	link := func(offset int, rel string) string {
+		u := *c.Request.URL
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(page.Limit))
+		q.Set("offset", strconv.Itoa(offset))
+		u.RawQuery = q.Encode()
+		return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+	}
+
+	lastOffset := 0
+	if page.Total > 0 {
+		lastOffset = (page.Total - 1) / page.Limit * page.Limit
+	}
+	links := []string{link(0, "first")}
+	if page.Offset > 0 {
+		links = append(links, link(max(page.Offset-page.Limit, 0), "prev"))
+	}
+	if page.Offset+page.Limit < page.Total {
+		links = append(links, link(page.Offset+page.Limit, "next"))
+	}
+	links = append(links, link(lastOffset, "last"))
+	return strings.Join(links, ", ")
+}
+
+// albumsLastModified returns when the Albums table last changed: the newest
+// created_at/updated_at, or the latest deletion if that came after. The zero
+// time means nothing has been recorded yet.
+func albumsLastModified(ctx context.Context) (time.Time, error) {
+	var updated, deleted sql.NullInt64
+	err := replicaQueryRow(ctx, "SELECT UNIX_TIMESTAMP(MAX(updated_at)) FROM Albums").Scan(&updated)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = replicaQueryRow(ctx, "SELECT UNIX_TIMESTAMP(last_deleted_at) FROM album_changes WHERE id = 1").Scan(&deleted)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+
+	latest := max(updated.Int64, deleted.Int64)
+	if latest == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(latest, 0).UTC(), nil
+}
+
+// ListAlbums handles paginated album listing, optionally narrowed to albums
+// created between created_after and created_before. It honors
+// If-Modified-Since against the table's last modification so pollers can
+// skip unchanged pages.
+func listAlbums(c *gin.Context) {
+	var filter albumFilter
+	if !parseCreatedRange(c, &filter) {
+		return
+	}
+	page, ok := parsePagination(c)
+	if !ok {
+		return
+	}
+
+	lastModified, err := albumsLastModified(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+		if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !lastModified.After(since) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+
+	stop := startTiming(c, timingDB)
+	where := filter.whereClause()
+	total, err := countAlbums(c.Request.Context(), "SELECT COUNT(*) FROM Albums"+where, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	page.Total = total
+	if !capResultRows(c, &page) {
+		return
+	}
+
+	query := "SELECT " + albumSummaryColumns + " FROM Albums" + where + " ORDER BY id LIMIT ? OFFSET ?"
+	rows, err := replicaQuery(c.Request.Context(), query, append(filter.args, page.rowLimit(), page.Offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	albums, err := scanAlbumSummaries(rows)
+	stop()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	respondPage(c, albums, page)
+}
+
+// albumSortColumns whitelists the sort keys accepted by the filter endpoint
+var albumSortColumns = map[string]string{
+	"id":     "id",
+	"artist": "artist",
+	"title":  "title",
+	"year":   "year",
+}
+
+// Bounds accepted for the decade filter
+const (
+	minDecade = 1800
+	maxDecade = 2100
+)
+
+// likeEscaper escapes LIKE wildcards so user input only matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// albumFilter is a parameterized WHERE clause built from query parameters
+type albumFilter struct {
+	conds []string
+	args  []any
+}
+
+// whereClause renders the filter, or an empty string when nothing was set
+func (f albumFilter) whereClause() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// parseAlbumFilter builds a filter from year_min, year_max, decade,
+// created_after, created_before, artist and title. Parameters that are absent
+// are ignored; artist and title match substrings case-insensitively.
+func parseAlbumFilter(c *gin.Context) (albumFilter, bool) {
+	var f albumFilter
+
+	yearMin, hasMin, ok := optionalIntQuery(c, "year_min")
+	if !ok {
+		return f, false
+	}
+	yearMax, hasMax, ok := optionalIntQuery(c, "year_max")
+	if !ok {
+		return f, false
+	}
+	if hasMin && hasMax && yearMin > yearMax {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "year_min must not be greater than year_max"})
+		return f, false
+	}
+	if hasMin {
+		f.conds = append(f.conds, "year >= ?")
+		f.args = append(f.args, yearMin)
+	}
+	if hasMax {
+		f.conds = append(f.conds, "year <= ?")
+		f.args = append(f.args, yearMax)
+	}
+
+	// A decade narrows the range further when combined with year_min/year_max
+	decade, hasDecade, ok := optionalIntQuery(c, "decade")
+	if !ok {
+		return f, false
+	}
+	if hasDecade {
+		if decade%10 != 0 || decade < minDecade || decade > maxDecade {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf(
+				"decade must be a multiple of 10 between %d and %d", minDecade, maxDecade)})
+			return f, false
+		}
+		f.conds = append(f.conds, "year BETWEEN ? AND ?")
+		f.args = append(f.args, decade, decade+9)
+	}
+
+	if !parseCreatedRange(c, &f) {
+		return f, false
+	}
+
+	// Match against the normalized columns so results don't depend on case
+	// or on the column collation
+	if artist := matchKey(c.Query("artist")); artist != "" {
+		f.conds = append(f.conds, "artist_norm LIKE ?")
+		f.args = append(f.args, "%"+likeEscaper.Replace(artist)+"%")
+	}
+	if title := matchKey(c.Query("title")); title != "" {
+		f.conds = append(f.conds, "title_norm LIKE ?")
+		f.args = append(f.args, "%"+likeEscaper.Replace(title)+"%")
+	}
+
+	return f, true
+}
+
+// parseCreatedRange adds the created_after and created_before parameters,
+// RFC 3339 timestamps, to f. The range includes created_after and excludes
+// created_before, so consecutive windows used for incremental syncs neither
+// overlap nor leave gaps.
+func parseCreatedRange(c *gin.Context, f *albumFilter) bool {
+	after, hasAfter, ok := optionalTimeQuery(c, "created_after")
+	if !ok {
+		return false
+	}
+	before, hasBefore, ok := optionalTimeQuery(c, "created_before")
+	if !ok {
+		return false
+	}
+	if hasAfter && hasBefore && after.After(before) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "created_after must not be later than created_before"})
+		return false
+	}
+	// FROM_UNIXTIME converts into the session time zone, the same one
+	// TIMESTAMP columns are compared in, whatever the server is set to
+	if hasAfter {
+		f.conds = append(f.conds, "created_at >= FROM_UNIXTIME(?)")
+		f.args = append(f.args, unixTimeArg(after))
+	}
+	if hasBefore {
+		f.conds = append(f.conds, "created_at < FROM_UNIXTIME(?)")
+		f.args = append(f.args, unixTimeArg(before))
+	}
+	return true
+}
+
+// optionalTimeQuery reads an RFC 3339 timestamp query parameter that may be
+// absent. A malformed value is answered with 400 and ok == false.
+func optionalTimeQuery(c *gin.Context, name string) (t time.Time, present, ok bool) {
+	v := c.Query(name)
+	if v == "" {
+		return time.Time{}, false, true
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 timestamp"})
+		return time.Time{}, false, false
+	}
+	return t, true, true
+}
+
+// unixTimeArg renders t as decimal Unix seconds for FROM_UNIXTIME. Times
+// before the epoch become 0, which no TIMESTAMP precedes.
+func unixTimeArg(t time.Time) string {
+	if t.Unix() < 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
+
+// optionalIntQuery reads an integer query parameter that may be absent. A
+// malformed value is answered with 400 and ok == false.
+func optionalIntQuery(c *gin.Context, name string) (n int, present, ok bool) {
+	v := c.Query(name)
+	if v == "" {
+		return 0, false, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an integer"})
+		return 0, false, false
+	}
+	return n, true, true
+}
+
+// parseAlbumSort turns the sort parameter into an ORDER BY clause. A leading
+// "-" sorts descending; ties are broken by id so pages stay stable.
+func parseAlbumSort(c *gin.Context) (string, bool) {
+	key := c.DefaultQuery("sort", "id")
+	dir := "ASC"
+	if strings.HasPrefix(key, "-") {
+		key, dir = key[1:], "DESC"
+	}
+	column, ok := albumSortColumns[key]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of id, artist, title, year"})
+		return "", false
+	}
+	if column == "id" {
+		return " ORDER BY id " + dir, true
+	}
+	return " ORDER BY " + column + " " + dir + ", id " + dir, true
+}
+
+// FilterAlbums handles listing albums matching combined filter criteria
+func filterAlbums(c *gin.Context) {
+	filter, ok := parseAlbumFilter(c)
+	if !ok {
+		return
+	}
+	orderBy, ok := parseAlbumSort(c)
+	if !ok {
+		return
+	}
+	page, ok := parsePagination(c)
+	if !ok {
+		return
+	}
+
+	where := filter.whereClause()
+	stop := startTiming(c, timingDB)
+	total, err := countAlbums(c.Request.Context(), "SELECT COUNT(*) FROM Albums"+where, filter.args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	page.Total = total
+	if !capResultRows(c, &page) {
+		return
+	}
+
+	query := "SELECT " + albumSummaryColumns + " FROM Albums" + where + orderBy + " LIMIT ? OFFSET ?"
+	rows, err := replicaQuery(c.Request.Context(), query, append(filter.args, page.rowLimit(), page.Offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	albums, err := scanAlbumSummaries(rows)
+	stop()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if len(albums) == 0 && cfg.EmptySearchNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No albums match the query"})
+		return
+	}
+
+	respondPage(c, albums, page)
+}
+
+// SimilarAlbums lists other albums by the same artist or from the same year
+// as the given one, same-artist matches first
+func similarAlbums(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	var artistNorm string
+	var year int
+	err = replicaQueryRow(c.Request.Context(), "SELECT artist_norm, year FROM Albums WHERE id = ?", albumID).Scan(&artistNorm, &year)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	query := "SELECT " + albumSummaryColumns + ` FROM Albums
+		WHERE id <> ? AND (artist_norm = ? OR year = ?)
+		ORDER BY artist_norm = ? DESC, year = ? DESC, id
+		LIMIT ?`
+	rows, err := replicaQuery(c.Request.Context(), query, albumID, artistNorm, year, artistNorm, year,
+		min(cfg.SimilarAlbumsLimit, cfg.MaxResultRows))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	albums, err := scanAlbumSummaries(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, albums)
+}
+
+// AlbumsSince lists albums with an ID above the watermark in ascending ID
+// order, so a poller can pass the last ID it processed and receive only what
+// arrived since. Images are left out unless images=true.
+func albumsSince(c *gin.Context) {
+	since, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || since < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+	page, ok := parsePagination(c)
+	if !ok {
+		return
+	}
+	withImages := c.Query("images") == "true"
+
+	columns := albumSummaryColumns
+	if withImages {
+		columns += ", image"
+	}
+	// Fetch one extra row to learn whether another poll would return more
+	query := "SELECT " + columns + " FROM Albums WHERE id > ? ORDER BY id LIMIT ?"
+	rows, err := replicaQuery(c.Request.Context(), query, since, page.Limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	albums := []Album{}
+	for rows.Next() {
+		var a Album
+		dest := a.summaryDest()
+		if withImages {
+			dest = append(dest, &a.Image)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		albums = append(albums, a)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	hasMore := len(albums) > page.Limit
+	if hasMore {
+		albums = albums[:page.Limit]
+	}
+	// With nothing new the watermark stays where the caller left it
+	watermark := since
+	if len(albums) > 0 {
+		watermark = albums[len(albums)-1].ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": albums, "watermark": watermark, "hasMore": hasMore})
+}
+
+// imageHashPattern matches the lowercase hex SHA-256 stored in image_hash
+var imageHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// AlbumsByImageHash lists every album whose cover has the given SHA-256. An
+// unknown hash yields an empty page rather than 404.
+func albumsByImageHash(c *gin.Context) {
+	hash := strings.ToLower(c.Param("hash"))
+	if !imageHashPattern.MatchString(hash) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "hash must be a 64-character hex SHA-256"})
+		return
+	}
+	page, ok := parsePagination(c)
+	if !ok {
+		return
+	}
+
+	total, err := countAlbums(c.Request.Context(), "SELECT COUNT(*) FROM Albums WHERE image_hash = ?", hash)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	page.Total = total
+	if !capResultRows(c, &page) {
+		return
+	}
+
+	query := "SELECT " + albumSummaryColumns + " FROM Albums WHERE image_hash = ? ORDER BY id LIMIT ? OFFSET ?"
+	rows, err := replicaQuery(c.Request.Context(), query, hash, page.rowLimit(), page.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	albums, err := scanAlbumSummaries(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	respondPage(c, albums, page)
+}
+
+// yearsCacheTTL is how long the distinct year list is reused
+const yearsCacheTTL = 30 * time.Second
+
+// yearCount is one entry of the albums/years response
+type yearCount struct {
+	Year  int `json:"year"`
+	Count int `json:"count"`
+}
+
+// yearsCache holds the last distinct year list
+var yearsCache struct {
+	sync.Mutex
+	years   []yearCount
+	expires time.Time
+}
+
+// AlbumYears lists the distinct years albums were released in, ascending,
+// for building a year filter. ?counts=true includes the number of albums
+// per year. The list is cached for yearsCacheTTL.
+func albumYears(c *gin.Context) {
+	years, err := distinctYears(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if withCounts, _ := strconv.ParseBool(c.Query("counts")); withCounts {
+		c.JSON(http.StatusOK, gin.H{"years": years})
+		return
+	}
+	plain := make([]int, len(years))
+	for i, y := range years {
+		plain[i] = y.Year
+	}
+	c.JSON(http.StatusOK, gin.H{"years": plain})
+}
+
+// distinctYears returns every year with its album count, from yearsCache
+// when fresh
+func distinctYears(ctx context.Context) ([]yearCount, error) {
+	yearsCache.Lock()
+	defer yearsCache.Unlock()
+	if yearsCache.years != nil && time.Now().Before(yearsCache.expires) {
+		return yearsCache.years, nil
+	}
+
+	// Served from idx_albums_year
+	rows, err := replicaQuery(ctx, "SELECT year, COUNT(*) FROM Albums GROUP BY year ORDER BY year")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	years := []yearCount{}
+	for rows.Next() {
+		var y yearCount
+		if err := rows.Scan(&y.Year, &y.Count); err != nil {
+			return nil, err
+		}
+		years = append(years, y)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	yearsCache.years, yearsCache.expires = years, time.Now().Add(yearsCacheTTL)
+	return years, nil
+}
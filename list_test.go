@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResultRowCapAppliesToMatchingRows(t *testing.T) {
+	prevMax, prevReject := cfg.MaxResultRows, cfg.RejectOversizedResults
+	t.Cleanup(func() { cfg.MaxResultRows, cfg.RejectOversizedResults = prevMax, prevReject })
+	cfg.MaxResultRows = 3
+
+	tests := []struct {
+		name       string
+		reject     bool
+		offset     string
+		wantStatus int
+		wantLimit  int64
+	}{
+		{"truncate first page", false, "0", http.StatusOK, 3},
+		{"truncate page straddling the cap", false, "2", http.StatusOK, 1},
+		{"truncate page past the cap", false, "5", http.StatusOK, 0},
+		{"reject", true, "0", http.StatusBadRequest, -1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.RejectOversizedResults = tt.reject
+			limit := int64(-1)
+			useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+				if queryIs(query, "SELECT COUNT(*)") {
+					return fakeResult{rows: [][]driver.Value{{int64(10)}}}, nil
+				}
+				limit = args[1].Value.(int64)
+				return fakeResult{}, nil
+			})
+
+			// A distinct hash per case keeps the count cache out of the way
+			hash := strings.Repeat(string(rune('a'+i)), 64)
+			w := serve(func(r *gin.Engine) { r.GET("/albums/by-hash/:hash", albumsByImageHash) },
+				httptest.NewRequest(http.MethodGet, "/albums/by-hash/"+hash+"?limit=5&offset="+tt.offset, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body)
+			}
+			if limit != tt.wantLimit {
+				t.Errorf("fetched %d rows, want %d", limit, tt.wantLimit)
+			}
+			if tt.wantStatus == http.StatusOK && w.Header().Get("X-Result-Truncated") != "true" {
+				t.Error("truncated result is not flagged")
+			}
+		})
+	}
+}
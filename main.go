@@ -1,140 +1,769 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
-	"io"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
 	"log"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/go-sql-driver/mysql"
 )
 
 // Album represents an album entity
 type Album struct {
-	ID     int    `json:"id,omitempty"`
-	Artist string `json:"artist"`
-	Title  string `json:"title"`
-	Year   int    `json:"year"`
-	Image  []byte `json:"image,omitempty"`
+	ID       int64  `json:"id,omitempty"`
+	Artist   string `json:"artist"`
+	Title    string `json:"title"`
+	Year     int    `json:"year"`
+	Filename string `json:"filename,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Image    []byte `json:"image,omitempty"`
+
+	// The year as given when it was approximate, such as "199X"; Year then
+	// holds the earliest year it can mean
+	YearText *string `json:"yearText,omitempty"`
+
+	// Optional catalog details; nil when unknown
+	TrackCount      *int `json:"trackCount,omitempty"`
+	DurationSeconds *int `json:"durationSeconds,omitempty"`
+
+	// Optional industry codes, stored normalized; each is unique
+	UPC  *string `json:"upc,omitempty"`
+	ISRC *string `json:"isrc,omitempty"`
+
+	// Only filled in by the popularity listing
+	ViewCount int64 `json:"viewCount,omitempty"`
 }
 
-// Global DB instance
-var db *sql.DB
+// albumUpdate is the JSON body accepted by updateAlbum
+type albumUpdate struct {
+	Artist  string `json:"artist"`
+	Title   string `json:"title"`
+	Year    int    `json:"year"`
+	Version *int   `json:"version"`
+
+	TrackCount      *int `json:"trackCount"`
+	DurationSeconds *int `json:"durationSeconds"`
+
+	UPC  *string `json:"upc"`
+	ISRC *string `json:"isrc"`
+}
+
+// allowedImageExtensions maps each upload extension the service supports to
+// the content type its bytes must sniff as. ALLOWED_IMAGE_TYPES can narrow
+// the accepted types further.
+var allowedImageExtensions = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// validationError carries a client-facing message for input that was
+// understood but rejected. Handlers answer those with 422 Unprocessable
+// Entity, and keep 400 Bad Request for requests they can't parse at all: a
+// malformed multipart or JSON body, JSON values of the wrong type, or a bad
+// album ID or header. A missing or out-of-range field is a 422.
+type validationError struct {
+	msg string
+}
 
-func initDB() {
-	// Read MySQL DSN from environment variable
-	dsn := os.Getenv("DB_DSN")
-	if dsn == "" {
-		log.Fatal("DB_DSN environment variable not set")
+func (e *validationError) Error() string { return e.msg }
+
+// albumInput is an album that passed validation and is ready to insert
+type albumInput struct {
+	artist, title string
+	year          int
+	yearText      *string
+	filename      string
+	image         []byte
+	thumbnail     []byte
+	thumbnailSpec *string
+	phash         *int64
+
+	// recompress lets prepareThumbnail recompress an oversized JPEG. Only
+	// fresh creates set it; imports, replacements and upserts keep the
+	// bytes they were given.
+	recompress bool
+
+	trackCount, durationSeconds *int
+	upc, isrc                   *string
+}
+
+// imageInfo describes an image that passed validateImageFile
+type imageInfo struct {
+	ContentType   string
+	Width, Height int
+	Bytes         int
+}
+
+// validateImageFile checks an uploaded file's extension against the allowlist,
+// makes sure its bytes sniff as the type the extension promises and that the
+// image header decodes. With VERIFY_IMAGE_DECODE the whole image is decoded.
+func validateImageFile(filename string, data []byte) (imageInfo, error) {
+	expectedType, ok := allowedImageExtensions[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return imageInfo{}, &validationError{"Unsupported image file extension"}
+	}
+	if !cfg.AllowedImageTypes[expectedType] {
+		return imageInfo{}, &validationError{"Image type " + expectedType + " is not accepted"}
+	}
+	if detected := detectImageType(data); detected != expectedType {
+		return imageInfo{}, &validationError{"Image content (" + detected + ") does not match file extension"}
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return imageInfo{}, &validationError{"Image could not be decoded"}
+	}
+	if err := checkImagePixels(config); err != nil {
+		return imageInfo{}, &validationError{fmt.Sprintf("Image is %dx%d, exceeding the limit of %d pixels",
+			config.Width, config.Height, cfg.MaxImagePixels)}
+	}
+	// The header alone can't catch truncated or corrupt pixel data, which
+	// would only surface later when a thumbnail or card is rendered
+	if cfg.VerifyImageDecode {
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			return imageInfo{}, &validationError{"Image could not be decoded: " + err.Error()}
+		}
 	}
+	return imageInfo{ContentType: expectedType, Width: config.Width, Height: config.Height, Bytes: len(data)}, nil
+}
 
-	var err error
-	db, err = sql.Open("mysql", dsn)
+// newAlbumInput cleans and validates an album's metadata and image and renders
+// its thumbnail. Errors are *validationError.
+func newAlbumInput(artist, title string, year int, filename string, image []byte) (*albumInput, error) {
+	in, err := checkAlbumInput(artist, title, year, filename, image)
 	if err != nil {
-		log.Fatalf("Failed to open DB: %v", err)
+		return nil, err
 	}
+	in.prepareThumbnail()
+	return in, nil
+}
 
-	// Test the DB connection
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Failed to connect to DB: %v", err)
+// checkAlbumInput is newAlbumInput without the thumbnail, for callers that
+// only need to know whether an album would be accepted
+func checkAlbumInput(artist, title string, year int, filename string, image []byte) (*albumInput, error) {
+	artist, title = cleanField(artist), cleanField(title)
+	if artist == "" || title == "" {
+		return nil, &validationError{"Artist, title, and year are required"}
+	}
+	if year <= 0 {
+		return nil, &validationError{"Year must be a positive integer"}
+	}
+	if _, err := validateImageFile(filename, image); err != nil {
+		return nil, err
 	}
 
-	// Set connection pooling configurations
-	db.SetMaxOpenConns(88)
-	db.SetMaxIdleConns(30)
-	db.SetConnMaxLifetime(0)
+	return &albumInput{artist: artist, title: title, year: year, filename: filename, image: image}, nil
+}
 
-	// Create Albums table if it doesn't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS Albums (
-			id INT AUTO_INCREMENT PRIMARY KEY,
-			artist VARCHAR(255) NOT NULL,
-			year INT NOT NULL,
-			title VARCHAR(255) NOT NULL,
-			image MEDIUMBLOB NOT NULL
-		) ENGINE=InnoDB;
-	`)
+// prepareThumbnail renders the default thumbnail for the album and takes the
+// perceptual hash of its image, decoding it once for both. Oversized JPEGs
+// are recompressed at the same time when RECOMPRESS_ABOVE_BYTES is set and
+// in.recompress allows it. A
+// failure is only logged: the thumbnail can be rebuilt later by the
+// regenerate endpoint.
+func (in *albumInput) prepareThumbnail() {
+	src, format, err := decodeImage(in.image)
 	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+		log.Printf("Failed to decode image %q: %v", in.filename, err)
+		return
 	}
+	orientation := imageOrientation(in.image, format)
+	if in.recompress && format == "jpeg" {
+		if smaller, ok := recompressJPEG(in.image, src, orientation); ok {
+			log.Printf("Recompressed image %q from %d to %d bytes", in.filename, len(in.image), len(smaller))
+			in.image = smaller
+		}
+	}
+	phash := int64(averageHash(src, orientation))
+	in.phash = &phash
+
+	thumbnail, err := encodeThumbnail(src, orientation, cfg.ThumbnailWidth, cfg.ThumbnailQuality)
+	if err != nil {
+		log.Printf("Failed to create thumbnail for %q: %v", in.filename, err)
+		return
+	}
+	spec := thumbnailSpec()
+	in.thumbnail, in.thumbnailSpec = thumbnail, &spec
 }
 
-// CreateAlbum handles album creation
-func createAlbum(c *gin.Context) {
-	// Parse multipart form data
-	err := c.Request.ParseMultipartForm(10 << 20) // 10MB limit
+// setDetails validates and attaches the optional catalog details
+func (in *albumInput) setDetails(trackCount, durationSeconds *int) error {
+	if err := validateAlbumDetails(trackCount, durationSeconds); err != nil {
+		return err
+	}
+	in.trackCount, in.durationSeconds = trackCount, durationSeconds
+	return nil
+}
+
+// summary returns in as stored under albumID, without its image
+func (in *albumInput) summary(albumID int64) *Album {
+	return &Album{ID: albumID, Artist: in.artist, Title: in.title, Year: in.year, YearText: in.yearText, Filename: in.filename,
+		Version: 1, TrackCount: in.trackCount, DurationSeconds: in.durationSeconds, UPC: in.upc, ISRC: in.isrc}
+}
+
+// auditDetails summarizes in for the audit log
+func (in *albumInput) auditDetails() gin.H {
+	return gin.H{"artist": in.artist, "title": in.title, "year": in.year, "yearText": in.yearText, "filename": in.filename,
+		"trackCount": in.trackCount, "durationSeconds": in.durationSeconds, "upc": in.upc, "isrc": in.isrc}
+}
+
+// insertAlbum inserts in within tx and returns the new album's ID
+func insertAlbum(tx *sql.Tx, in *albumInput) (int64, error) {
+	query := `INSERT INTO Albums (artist, title, year, year_text, artist_norm, title_norm, filename, image, image_hash,
+			image_phash, thumbnail, thumbnail_spec, track_count, duration_seconds, upc, isrc)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, in.artist, in.title, in.year, in.yearText, matchKey(in.artist), matchKey(in.title),
+		in.filename, in.image, imageHash(in.image), in.phash, in.thumbnail, in.thumbnailSpec, in.trackCount,
+		in.durationSeconds, in.upc, in.isrc)
+	if err != nil {
+		return 0, err
+	}
+	albumID, err := result.LastInsertId()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
+		return 0, err
+	}
+	return albumID, claimUpsertIdentity(tx, albumID)
+}
+
+// claimUpsertIdentity makes albumID the album PUT /albums updates for its
+// artist, title and year, unless another album already holds that claim.
+// The idx_albums_upsert unique index allows one claim per identity, so the
+// duplicate key error just means the album is a duplicate.
+func claimUpsertIdentity(tx *sql.Tx, albumID int64) error {
+	_, err := tx.Exec("UPDATE Albums SET upsert_canonical = 1, updated_at = updated_at WHERE id = ?", albumID)
+	if isMySQLError(err, errDuplicateKey) {
+		return nil
+	}
+	return err
+}
+
+// countArtistAlbums counts the albums stored for artist with a locking read,
+// so two concurrent creates for the same artist can't both pass a quota
+// check. The read takes next-key locks on the artist's index range: a
+// transaction that would insert into a range another one has read waits for
+// it. When both have read the range first, their inserts wait on each other;
+// MySQL breaks the deadlock by rolling one back, and withTx retries it,
+// this time counting the other's album.
+func countArtistAlbums(tx *sql.Tx, artist string) (int, error) {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM Albums WHERE artist_norm = ? FOR UPDATE", matchKey(artist)).Scan(&count)
+	return count, err
+}
+
+// checkArtistQuota returns errArtistQuota when in's artist already has
+// MAX_ALBUMS_PER_ARTIST albums
+func checkArtistQuota(tx *sql.Tx, in *albumInput) error {
+	if cfg.MaxAlbumsPerArtist <= 0 {
+		return nil
+	}
+	count, err := countArtistAlbums(tx, in.artist)
+	if err != nil {
+		return err
+	}
+	if count >= cfg.MaxAlbumsPerArtist {
+		return errArtistQuota
+	}
+	return nil
+}
+
+// respondCreateError writes the response for a failed createAlbumRecord
+func respondCreateError(c *gin.Context, err error) {
+	if errors.Is(err, errArtistQuota) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Artist has reached the limit of %d albums", cfg.MaxAlbumsPerArtist)})
 		return
 	}
+	respondTxError(c, err, "Failed to insert album")
+}
+
+// createAlbumRecord inserts in and its audit entry in one transaction,
+// enforcing the per-artist quota
+func createAlbumRecord(ctx context.Context, in *albumInput, actor string) (int64, error) {
+	var albumID int64
+	err := withTx(ctx, func(tx *sql.Tx) error {
+		if err := checkArtistQuota(tx, in); err != nil {
+			return err
+		}
+		var err error
+		if albumID, err = insertAlbum(tx, in); err != nil {
+			return err
+		}
+		return writeAudit(tx, albumID, auditCreate, actor, in.auditDetails())
+	})
+	if err == nil {
+		publishAlbumEvent(albumEvent{Type: auditCreate, AlbumID: albumID, Album: in.summary(albumID)})
+	}
+	return albumID, err
+}
 
-	artist := c.Request.FormValue("artist")
-	title := c.Request.FormValue("title")
-	yearStr := c.Request.FormValue("year")
+// readAlbumForm parses and validates the multipart album upload shared by
+// createAlbum and upsertAlbum, recompressing an oversized JPEG when
+// recompress is set. On failure it writes the response and returns false.
+func readAlbumForm(c *gin.Context, recompress bool) (*albumInput, bool) {
+	// Parse multipart form data
+	var spoolDir string
+	if cfg.SpoolUploads {
+		spoolDir = cfg.SpoolDir
+	}
+	form, err := readSpooledUploadForm(c.Request, spoolDir)
+	if err != nil {
+		respondUploadFormError(c, err)
+		return nil, false
+	}
+	defer form.removeSpooled()
+
+	artist := cleanField(form.value("artist"))
+	title := cleanField(form.value("title"))
+	yearStr := form.value("year")
 
 	// Validate required fields
 	if artist == "" || title == "" || yearStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Artist, title, and year are required"})
-		return
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Artist, title, and year are required"})
+		return nil, false
 	}
 
-	year, err := strconv.Atoi(yearStr)
-	if err != nil || year <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Year must be a positive integer"})
-		return
+	year, yearText, err := parseFormYear(yearStr)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return nil, false
 	}
 
 	// Read image file
-	file, err := c.FormFile("image")
+	file, ok := form.file("image")
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Image is required"})
+		return nil, false
+	}
+
+	trackCount, err := optionalFormInt(form, "trackCount")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Image is required"})
-		return
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	durationSeconds, err := optionalFormInt(form, "durationSeconds")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return nil, false
 	}
 
-	openedFile, err := file.Open()
+	recordUploadSize(c, int(file.size))
+	if rejectDeniedArtist(c, artist) {
+		return nil, false
+	}
+
+	// A spooled image is only read back once the cheap checks have passed
+	data, err := file.load()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process image file"})
-		return
+		log.Printf("Failed to read spooled upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		return nil, false
 	}
-	defer openedFile.Close()
 
-	imageData, err := io.ReadAll(openedFile)
+	// Validate the metadata and make sure the image bytes match the extension
+	stop := startTiming(c, timingValidation)
+	in, err := checkAlbumInput(artist, title, year, file.filename, data)
+	if err == nil {
+		in.yearText = yearText
+		err = in.setDetails(trackCount, durationSeconds)
+	}
+	if err == nil {
+		err = in.setCodes(form.value("upc"), form.value("isrc"))
+	}
+	stop()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image file"})
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	stop = startTiming(c, timingImage)
+	in.recompress = recompress
+	in.prepareThumbnail()
+	stop()
+	return in, true
+}
+
+// CreateAlbum handles album creation
+func createAlbum(c *gin.Context) {
+	in, ok := readAlbumForm(c, true)
+	if !ok {
+		return
+	}
+
+	if cfg.AsyncInserts {
+		if !enqueueAlbum(in, requestActor(c)) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Insert queue is full, please retry"})
+			return
+		}
+		// The ID is only assigned once the batch is written
+		c.JSON(http.StatusAccepted, gin.H{"status": "queued", "requestId": c.GetString("requestID")})
 		return
 	}
 
 	// Insert into database
-	query := "INSERT INTO Albums (artist, title, year, image) VALUES (?, ?, ?, ?)"
-	result, err := db.Exec(query, artist, title, year, imageData)
+	stop := startTiming(c, timingDB)
+	albumID, deduped, err := createAlbumOnce(c.Request.Context(), in, requestActor(c))
+	stop()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert album"})
+		respondCreateError(c, err)
 		return
 	}
+	if deduped {
+		c.Header("X-Deduplicated", "true")
+	}
 
-	albumID, err := result.LastInsertId()
+	c.JSON(http.StatusCreated, gin.H{"AlbumID": albumID})
+}
+
+// ValidateImage runs an uploaded image through the checks createAlbum applies
+// and reports what it found, without storing anything
+func validateImage(c *gin.Context) {
+	form, err := readUploadForm(c.Request)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve album ID"})
+		respondUploadFormError(c, err)
+		return
+	}
+	file, ok := form.file("image")
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Image is required"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"AlbumID": albumID})
+	info, err := validateImageFile(file.filename, file.data)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"valid": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "contentType": info.ContentType,
+		"width": info.Width, "height": info.Height, "bytes": info.Bytes})
 }
 
 // GetAlbum handles album retrieval
 func getAlbum(c *gin.Context) {
-	albumID, err := strconv.Atoi(c.Param("id"))
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	var album Album
+	stop := startTiming(c, timingDB)
+	query := "SELECT " + albumSummaryColumns + ", image FROM Albums WHERE id = ?"
+	err = replicaQueryRow(c.Request.Context(), query, albumID).Scan(append(album.summaryDest(), &album.Image)...)
+	stop()
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	recordView(album.ID)
+
+	c.Header("ETag", strconv.Quote(strconv.Itoa(album.Version)))
+	c.JSON(http.StatusOK, album)
+}
+
+// CheckDuplicate reports whether an album with the given artist, title and
+// year already exists, comparing them the way the insert path normalizes them
+func checkDuplicate(c *gin.Context) {
+	artist, title := matchKey(c.Query("artist")), matchKey(c.Query("title"))
+	year, err := strconv.Atoi(c.Query("year"))
+	if artist == "" || title == "" || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Artist, title, and year are required"})
+		return
+	}
+
+	var albumID int64
+	query := "SELECT id FROM Albums WHERE artist_norm = ? AND title_norm = ? AND year = ? ORDER BY id LIMIT 1"
+	err = readQueryRow(c.Request.Context(), query, artist, title, year).Scan(&albumID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, gin.H{"duplicate": false})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"duplicate": true, "albumId": albumID})
+}
+
+// parseVersionTag extracts the album version from an If-Match header value.
+// An empty header or "*" matches any version and yields ok == false.
+func parseVersionTag(header string) (version int, ok bool, err error) {
+	tag := strings.TrimSpace(header)
+	if tag == "" || tag == "*" {
+		return 0, false, nil
+	}
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+	version, err = strconv.Atoi(tag)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+// UpdateAlbum handles album metadata updates. Callers pass the version they
+// last read via If-Match or the version field; a stale version yields 409.
+func updateAlbum(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
 		return
 	}
 
+	var req albumUpdate
+	if !decodeJSONBody(c, &req) {
+		return
+	}
+
+	// Validate required fields
+	req.Artist, req.Title = cleanField(req.Artist), cleanField(req.Title)
+	if err := validateAlbumFields(req.Artist, req.Title, req.Year); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateAlbumDetails(req.TrackCount, req.DurationSeconds); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if req.UPC, req.ISRC, err = normalizeAlbumCodes(req.UPC, req.ISRC); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if rejectDeniedArtist(c, req.Artist) {
+		return
+	}
+
+	// The header takes precedence over the body
+	expected, conditional, err := parseVersionTag(c.GetHeader("If-Match"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match must be an album version"})
+		return
+	}
+	if !conditional && req.Version != nil {
+		expected, conditional = *req.Version, true
+	}
+
+	actor := requestActor(c)
 	var album Album
-	query := "SELECT id, artist, title, year, image FROM Albums WHERE id = ?"
-	err = db.QueryRow(query, albumID).Scan(&album.ID, &album.Artist, &album.Title, &album.Year, &album.Image)
+	err = withTx(c.Request.Context(), func(tx *sql.Tx) error {
+		query := "SELECT id, filename, version FROM Albums WHERE id = ? FOR UPDATE"
+		err := tx.QueryRow(query, albumID).Scan(&album.ID, &album.Filename, &album.Version)
+		if err == sql.ErrNoRows {
+			return errAlbumNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if conditional && expected != album.Version {
+			return errVersionConflict
+		}
+
+		album.Artist, album.Title, album.Year = req.Artist, req.Title, req.Year
+		// Like the other fields, details left out of the body are cleared
+		album.TrackCount, album.DurationSeconds = req.TrackCount, req.DurationSeconds
+		album.UPC, album.ISRC = req.UPC, req.ISRC
+		return writeAlbumUpdate(tx, &album, actor)
+	})
+	if errors.Is(err, errAlbumNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if errors.Is(err, errVersionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Album was modified concurrently", "version": album.Version})
+		return
+	} else if err != nil {
+		respondTxError(c, err, "Failed to update album")
+		return
+	}
+	invalidateCard(album.ID)
+	publishAlbumEvent(albumEvent{Type: auditUpdate, AlbumID: album.ID, Album: &album})
+
+	c.Header("ETag", strconv.Quote(strconv.Itoa(album.Version)))
+	c.JSON(http.StatusOK, album)
+}
+
+// validateAlbumFields checks the metadata every stored album must have
+func validateAlbumFields(artist, title string, year int) error {
+	if artist == "" || title == "" || year == 0 {
+		return &validationError{"Artist, title, and year are required"}
+	}
+	if year < 0 {
+		return &validationError{"Year must be a positive integer"}
+	}
+	return nil
+}
+
+// validateAlbumDetails checks the optional catalog details when present
+func validateAlbumDetails(trackCount, durationSeconds *int) error {
+	if trackCount != nil && *trackCount < 0 {
+		return &validationError{"Track count must be a non-negative integer"}
+	}
+	if durationSeconds != nil && *durationSeconds < 0 {
+		return &validationError{"Duration must be a non-negative number of seconds"}
+	}
+	return nil
+}
+
+// writeAlbumUpdate stores album's metadata, bumps its version and records
+// the change. The row must already be locked by the caller. An album whose
+// artist, title or year changes gives up its upsert claim and claims the new
+// identity if it is free.
+func writeAlbumUpdate(tx *sql.Tx, album *Album, actor string) error {
+	// MySQL assigns left to right, so the IF still sees the old values
+	query := `UPDATE Albums SET upsert_canonical = IF(artist_norm = ? AND title_norm = ? AND year = ?, upsert_canonical, NULL),
+		artist = ?, title = ?, year = ?, year_text = ?, artist_norm = ?, title_norm = ?,
+		track_count = ?, duration_seconds = ?, upc = ?, isrc = ?, version = version + 1 WHERE id = ?`
+	_, err := tx.Exec(query, matchKey(album.Artist), matchKey(album.Title), album.Year,
+		album.Artist, album.Title, album.Year, album.YearText, matchKey(album.Artist),
+		matchKey(album.Title), album.TrackCount, album.DurationSeconds, album.UPC, album.ISRC, album.ID)
+	if err != nil {
+		return err
+	}
+	if err := claimUpsertIdentity(tx, album.ID); err != nil {
+		return err
+	}
+	album.Version++
+	details := gin.H{"artist": album.Artist, "title": album.Title, "year": album.Year, "version": album.Version,
+		"trackCount": album.TrackCount, "durationSeconds": album.DurationSeconds, "upc": album.UPC, "isrc": album.ISRC}
+	return writeAudit(tx, album.ID, auditUpdate, actor, details)
+}
+
+// convertedKey identifies one converted image in convertedCache
+type convertedKey struct {
+	albumID int64
+	format  string
+}
+
+// convertedImage is an image re-encoded for the format query parameter
+type convertedImage struct {
+	filename string
+	etag     string
+	data     []byte
+}
+
+// convertedCache holds recently converted images
+var convertedCache *lruCache[convertedKey, convertedImage]
+
+// GetAlbumImage serves the raw cover image under its original filename. With
+// ?format=jpeg, png or webp it is converted first, unless already stored in
+// that format. WebP can't be encoded, so asking for it answers 415 unless the
+// stored image is a WebP.
+func getAlbumImage(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	format := strings.ToLower(c.Query("format"))
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if _, ok := convertFormats[format]; format != "" && !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of jpeg, png or webp"})
+		return
+	}
+	if format != "" {
+		if converted, ok := convertedCache.Get(convertedKey{albumID, format}); ok {
+			c.Header("ETag", converted.etag)
+			serveAlbumImage(c, converted.filename, convertFormats[format], converted.data)
+			return
+		}
+	}
+
+	var filename string
+	var image []byte
+	var hash sql.NullString
+	stop := startTiming(c, timingDB)
+	query := "SELECT filename, image, image_hash FROM Albums WHERE id = ?"
+	err = replicaQueryRow(c.Request.Context(), query, albumID).Scan(&filename, &image, &hash)
+	stop()
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	etag := imageETag(image, hash)
+	contentType := detectImageType(image)
+	if format != "" && convertFormats[format] != contentType {
+		stop := startTiming(c, timingImage)
+		converted, err := convertImage(image, format)
+		stop()
+		if errors.Is(err, errNoEncoder) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Converting to " + format + " is not supported"})
+			return
+		} else if err != nil {
+			log.Printf("Failed to convert album %d image to %s: %v", albumID, format, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to convert image"})
+			return
+		}
+		image, contentType = converted, convertFormats[format]
+		if filename != "" {
+			filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + format
+		}
+		// A converted rendition is a different representation of the same
+		// stored image, so it gets a weak tag that If-Match never accepts
+		etag = "W/" + etag
+		convertedCache.Add(convertedKey{albumID, format}, convertedImage{filename: filename, etag: etag, data: image})
+	}
+
+	c.Header("ETag", etag)
+	serveAlbumImage(c, filename, contentType, image)
+}
+
+// serveAlbumImage writes an image inline under filename
+func serveAlbumImage(c *gin.Context, filename, contentType string, image []byte) {
+	// Rows created before filenames were recorded have none to offer
+	if filename != "" {
+		c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	}
+	c.Data(http.StatusOK, contentType, image)
+}
+
+// imageExtensions maps a sniffed content type to the extension used when
+// naming downloads
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// DownloadAlbumImage serves the cover image as an attachment named after the
+// album
+func downloadAlbumImage(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	var artist, title string
+	var image []byte
+	var hash sql.NullString
+	query := "SELECT artist, title, image, image_hash FROM Albums WHERE id = ?"
+	err = replicaQueryRow(c.Request.Context(), query, albumID).Scan(&artist, &title, &image, &hash)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
 		return
@@ -143,24 +772,412 @@ func getAlbum(c *gin.Context) {
 		return
 	}
 
+	contentType := detectImageType(image)
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		ext = ".bin"
+	}
+	filename := sanitizeFilename(artist) + "-" + sanitizeFilename(title) + ext
+
+	c.Header("ETag", imageETag(image, hash))
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Data(http.StatusOK, contentType, image)
+}
+
+// ReplaceAlbumImage swaps an album's cover for the multipart "image" file.
+// If-Match must carry the ETag of the image being replaced, as served by the
+// image endpoints, so two clients can't overwrite each other's covers: a
+// missing header gets 428 and a stale one 412 with the current tag.
+func replaceAlbumImage(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match with the current image ETag is required"})
+		return
+	}
+
+	form, err := readUploadForm(c.Request)
+	if err != nil {
+		respondUploadFormError(c, err)
+		return
+	}
+	file, ok := form.file("image")
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Image is required"})
+		return
+	}
+	recordUploadSize(c, len(file.data))
+	if _, err := validateImageFile(file.filename, file.data); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	in := &albumInput{filename: file.filename, image: file.data}
+	in.prepareThumbnail()
+	newHash := imageHash(in.image)
+
+	actor := requestActor(c)
+	var album Album
+	var currentTag string
+	err = withTx(c.Request.Context(), func(tx *sql.Tx) error {
+		var hash sql.NullString
+		query := "SELECT " + albumSummaryColumns + ", COALESCE(image_hash, SHA2(image, 256)) FROM Albums WHERE id = ? FOR UPDATE"
+		err := tx.QueryRow(query, albumID).Scan(append(album.summaryDest(), &hash)...)
+		if err == sql.ErrNoRows {
+			return errAlbumNotFound
+		} else if err != nil {
+			return err
+		}
+		currentTag = strconv.Quote(hash.String)
+		if !ifMatchAccepts(ifMatch, currentTag) {
+			return errImageChanged
+		}
+
+		query = `UPDATE Albums SET filename = ?, image = ?, image_hash = ?, image_phash = ?, thumbnail = ?,
+			thumbnail_spec = ?, version = version + 1 WHERE id = ?`
+		_, err = tx.Exec(query, in.filename, in.image, newHash, in.phash, in.thumbnail, in.thumbnailSpec, albumID)
+		if err != nil {
+			return err
+		}
+		album.Filename = in.filename
+		album.Version++
+		details := gin.H{"filename": in.filename, "imageHash": newHash, "version": album.Version}
+		return writeAudit(tx, albumID, auditUpdate, actor, details)
+	})
+	if errors.Is(err, errAlbumNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if errors.Is(err, errImageChanged) {
+		c.Header("ETag", currentTag)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Album image was modified concurrently"})
+		return
+	} else if err != nil {
+		respondTxError(c, err, "Failed to replace image")
+		return
+	}
+	thumbnailCache.RemoveFunc(func(k thumbnailKey) bool { return k.albumID == albumID })
+	convertedCache.RemoveFunc(func(k convertedKey) bool { return k.albumID == albumID })
+	invalidateCard(albumID)
+	publishAlbumEvent(albumEvent{Type: auditUpdate, AlbumID: albumID, Album: &album})
+
+	c.Header("ETag", strconv.Quote(newHash))
 	c.JSON(http.StatusOK, album)
 }
 
+// sanitizeFilename keeps letters, digits, dots, dashes and underscores,
+// replacing runs of anything else with a single underscore
+func sanitizeFilename(name string) string {
+	var b strings.Builder
+	pendingSep := false
+	for _, r := range strings.TrimSpace(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			if pendingSep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			pendingSep = false
+			b.WriteRune(r)
+			continue
+		}
+		pendingSep = true
+	}
+
+	// Leading dots would produce hidden files
+	clean := strings.TrimLeft(b.String(), ".")
+	if clean == "" {
+		return "album"
+	}
+	return clean
+}
+
+// thumbnailKey identifies one thumbnail rendition in thumbnailCache
+type thumbnailKey struct {
+	albumID        int64
+	width, quality int
+}
+
+// thumbnailCache holds renditions generated on the fly for non-default sizes
+var thumbnailCache *lruCache[thumbnailKey, []byte]
+
+// GetAlbumThumbnail serves a JPEG thumbnail. The optional w and q query
+// parameters pick the width and JPEG quality; invalid values fall back to the
+// configured defaults and widths are capped at THUMBNAIL_MAX_WIDTH.
+func getAlbumThumbnail(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	width := queryIntInRange(c, "w", cfg.ThumbnailWidth, 1, math.MaxInt)
+	width = min(width, cfg.ThumbnailMaxWidth)
+	quality := queryIntInRange(c, "q", cfg.ThumbnailQuality, 1, 100)
+
+	// The default rendition is precomputed and stored with the album
+	if width == cfg.ThumbnailWidth && quality == cfg.ThumbnailQuality {
+		var thumbnail []byte
+		var spec sql.NullString
+		query := "SELECT thumbnail, thumbnail_spec FROM Albums WHERE id = ?"
+		err = replicaQueryRow(c.Request.Context(), query, albumID).Scan(&thumbnail, &spec)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if thumbnail != nil && spec.String == thumbnailSpec() {
+			c.Data(http.StatusOK, "image/jpeg", thumbnail)
+			return
+		}
+	}
+
+	key := thumbnailKey{albumID: albumID, width: width, quality: quality}
+	if thumbnail, ok := thumbnailCache.Get(key); ok {
+		c.Data(http.StatusOK, "image/jpeg", thumbnail)
+		return
+	}
+
+	var image []byte
+	stop := startTiming(c, timingDB)
+	err = replicaQueryRow(c.Request.Context(), "SELECT image FROM Albums WHERE id = ?", albumID).Scan(&image)
+	stop()
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	stop = startTiming(c, timingImage)
+	thumbnail, err := makeThumbnail(image, width, quality)
+	stop()
+	if err != nil {
+		log.Printf("Failed to create thumbnail for album %d: %v", albumID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate thumbnail"})
+		return
+	}
+	thumbnailCache.Add(key, thumbnail)
+
+	c.Data(http.StatusOK, "image/jpeg", thumbnail)
+}
+
+// queryIntInRange reads an integer query parameter, returning def when it is
+// absent, malformed, or outside [lo, hi]
+func queryIntInRange(c *gin.Context, name string, def, lo, hi int) int {
+	n, err := strconv.Atoi(c.Query(name))
+	if err != nil || n < lo || n > hi {
+		return def
+	}
+	return n
+}
+
+// deleteAlbumRows removes an album within tx and records the deletion,
+// reporting whether the album existed. No table references albums except
+// audit_log, whose history is kept on purpose.
+func deleteAlbumRows(tx *sql.Tx, albumID int64) (bool, error) {
+	result, err := tx.Exec("DELETE FROM Albums WHERE id = ?", albumID)
+	if err != nil {
+		return false, fmt.Errorf("delete album: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	// A deletion leaves MAX(updated_at) untouched, so record it separately
+	// for the list endpoint's Last-Modified
+	_, err = tx.Exec(`INSERT INTO album_changes (id, last_deleted_at) VALUES (1, NOW())
+		ON DUPLICATE KEY UPDATE last_deleted_at = NOW()`)
+	if err != nil {
+		return false, fmt.Errorf("record deletion: %w", err)
+	}
+	return true, nil
+}
+
+// DeleteAlbum handles album deletion. With dry_run=true it only reports what
+// would be deleted.
+func deleteAlbum(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	if c.Query("dry_run") == "true" {
+		var exists int
+		err := readQueryRow(c.Request.Context(), "SELECT 1 FROM Albums WHERE id = ?", albumID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"dryRun": true, "count": 1, "ids": []int64{albumID}})
+		return
+	}
+
+	actor := requestActor(c)
+	err = withTx(c.Request.Context(), func(tx *sql.Tx) error {
+		found, err := deleteAlbumRows(tx, albumID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errAlbumNotFound
+		}
+		return writeAudit(tx, albumID, auditDelete, actor, nil)
+	})
+	if errors.Is(err, errAlbumNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete album %d: %v", albumID, err)
+		respondTxError(c, err, "Failed to delete album")
+		return
+	}
+	thumbnailCache.RemoveFunc(func(k thumbnailKey) bool { return k.albumID == albumID })
+	convertedCache.RemoveFunc(func(k convertedKey) bool { return k.albumID == albumID })
+	invalidateCard(albumID)
+	publishAlbumEvent(albumEvent{Type: auditDelete, AlbumID: albumID})
+
+	c.Status(http.StatusNoContent)
+}
+
+// initCaches creates the in-memory caches sized by the configuration
+func initCaches() {
+	thumbnailCache = newLRUCache[thumbnailKey, []byte](cfg.ThumbnailCacheSize)
+	convertedCache = newLRUCache[convertedKey, convertedImage](cfg.ConvertedCacheSize)
+	cardCache = newLRUCache[int64, []byte](cfg.CardCacheSize)
+	recentErrors = newErrorRing(cfg.ErrorBufferSize)
+}
+
 func main() {
-	initDB()
-	defer db.Close()
+	benchmark := flag.Bool("benchmark", false, "run a create+get self-benchmark against the database and exit")
+	benchmarkN := flag.Int("benchmark-n", 1000, "number of create+get cycles for -benchmark")
+	benchmarkConcurrency := flag.Int("benchmark-concurrency", 10, "concurrent workers for -benchmark")
+	migrateOnly := flag.Bool("migrate-only", false, "bring the database schema up to date and exit without serving")
+	flag.Parse()
 
-	// Setup Gin engine
-	r := gin.Default()
+	loadConfig()
+	// initDB exits non-zero on any failure, which is what CI checks for
+	if *migrateOnly {
+		initDB()
+		closeDB()
+		log.Printf("Schema is at version %d", migrations[len(migrations)-1].version)
+		return
+	}
+	logFeatures()
+	initHealthChecks()
+	initCaches()
+	initUploads()
+	if *benchmark {
+		initDB()
+		defer closeDB()
+		if err := runBenchmark(*benchmarkN, *benchmarkConcurrency); err != nil {
+			log.Fatalf("Benchmark failed: %v", err)
+		}
+		return
+	}
+
+	// Setup Gin engine. Until initialization below finishes, only the health
+	// routes are served.
+	r := gin.New()
+	r.Use(trackInFlight(), requestID(), recordErrors(), gin.Recovery(), requestLogger(), skipCanceledResponses(), rejectUntilReady())
+	if cfg.DebugEndpoints {
+		r.Use(serverTiming())
+	}
+
+	// Only honor X-Forwarded-For from configured proxy hops. Everything keyed
+	// on c.ClientIP(), including per-client rate limiting, sees the proxy's
+	// address when the proxy isn't listed here, and a spoofable header value
+	// when an untrusted hop is.
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	r.Use(maxRequestSize(cfg.MaxRequestBytes), rateLimitByRoute(cfg.RateLimits))
+	if cfg.GlobalRateLimit.PerSecond > 0 {
+		r.Use(limitGlobalRate(cfg.GlobalRateLimit))
+	}
+	if cfg.DBMaxWaiters >= 0 {
+		r.Use(shedOnPoolSaturation(cfg.DBMaxWaiters))
+	}
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		r.Use(corsMiddleware())
+	}
 
 	// Health check route
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
+	r.GET("/health/ready", readinessHandler)
 
-	// Album routes
-	r.POST("/albums", createAlbum)
+	// Album routes. Writes are capped per client.
+	writeLimit := limitClientWrites(cfg.MaxConcurrentUploadsPerClient)
+	r.GET("/albums", listAlbums)
+	r.POST("/albums", writeLimit, createAlbum)
+	r.PUT("/albums", writeLimit, upsertAlbum)
+	r.GET("/albums/filter", featureRoute("search", filterAlbums))
+	r.GET("/albums/search", featureRoute("search", filterAlbums))
+	r.GET("/albums/check-duplicate", checkDuplicate)
+	r.GET("/albums/since/:id", albumsSince)
+	r.GET("/albums/popular", popularAlbums)
+	r.GET("/albums/years", albumYears)
+	r.GET("/albums/by-image-hash/:hash", albumsByImageHash)
+	r.GET("/albums/by-upc/:upc", albumByUPC)
+	r.GET("/albums/stream", streamAlbums)
+	r.GET("/albums/thumbnails/sprite", getThumbnailSprite)
+	r.POST("/albums/import.zip", writeLimit, featureRoute("import", importAlbumsZip))
+	r.POST("/albums/import", writeLimit, featureRoute("import", importAlbum))
+	r.POST("/albums/upload-url", writeLimit, directUploadRoute(createUploadURL))
+	r.POST("/albums/batch/validate", featureRoute("import", validateImportZip))
 	r.GET("/albums/:id", getAlbum)
+	r.GET("/albums/:id/image", getAlbumImage)
+	r.GET("/albums/:id/thumbnail", getAlbumThumbnail)
+	r.GET("/albums/:id/download", downloadAlbumImage)
+	r.GET("/albums/:id/card.png", getAlbumCard)
+	r.GET("/albums/:id/export", exportAlbum)
+	r.GET("/albums/:id/similar", similarAlbums)
+	r.GET("/albums/:id/similar-images", similarImages)
+	r.GET("/albums/:id/history", albumHistory)
+	r.PUT("/albums/:id", writeLimit, updateAlbum)
+	r.PUT("/albums/:id/image", writeLimit, replaceAlbumImage)
+	r.PATCH("/albums/:id", writeLimit, patchAlbum)
+	r.DELETE("/albums/:id", writeLimit, deleteAlbum)
+	r.POST("/albums/:id/confirm", writeLimit, directUploadRoute(confirmUpload))
+
+	r.POST("/images/validate", validateImage)
+	r.POST("/artists/merge", writeLimit, mergeArtists)
+
+	// Resumable upload routes
+	r.POST("/uploads", writeLimit, startUpload)
+	r.GET("/uploads/:id", getUpload)
+	r.PATCH("/uploads/:id", writeLimit, appendUpload)
+	r.POST("/uploads/:id/finalize", writeLimit, finalizeUpload)
+
+	// Admin routes
+	admin := r.Group("/admin", requireAdminKey())
+	admin.POST("/regenerate-thumbnails", regenerateThumbnails)
+	admin.POST("/reindex", reindexAlbums)
+	admin.GET("/errors", listRecentErrors)
+
+	// Debug routes. Migration status is also open to the admin key, for
+	// deploy checks against production, and the configuration always needs
+	// the key.
+	r.GET("/debug/migrations", requireDebugOrAdmin(), debugMigrations)
+	r.GET("/debug/config", requireAdminKey(), debugConfig)
+	if cfg.DebugEndpoints {
+		debug := r.Group("/debug")
+		debug.GET("/requests", debugRequests)
+		debug.GET("/storage", debugStorage)
+		debug.GET("/storage/largest", debugLargestImages)
+		debug.GET("/storage/smallest", debugSmallestImages)
+		debug.GET("/db", debugDBPools)
+	}
 
 	// Get port from environment variable or use default
 	port := os.Getenv("PORT")
@@ -168,6 +1185,29 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s ...", port)
-	r.Run(":" + port)
+	srv := &http.Server{Addr: ":" + port, Handler: methodOverride(r)}
+	srv.RegisterOnShutdown(closeAlbumEvents)
+	go func() {
+		log.Printf("Server starting on port %s ...", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	initDB()
+	defer closeDB()
+	warmPool(cfg.DBWarmupConns)
+	startViewFlusher(cfg.ViewFlushInterval)
+	if cfg.AsyncInserts {
+		startAsyncInserts()
+	}
+	markReady()
+
+	// Wait for a termination signal, then drain in-flight requests
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	shutdown(srv, cfg.ShutdownTimeout)
+	stopAsyncInserts()
+	flushViews()
 }
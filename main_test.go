@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serve runs one request through a router holding only the routes register
+// adds
+func serve(register func(r *gin.Engine), req *http.Request) *httptest.ResponseRecorder {
+	r := gin.New()
+	register(r)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestDeleteAlbumFailureLeavesNoRows(t *testing.T) {
+	// The album row is already gone inside the transaction when the audit
+	// insert, its last statement, fails
+	fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		switch {
+		case queryIs(query, "DELETE FROM Albums"):
+			return fakeResult{affected: 1}, nil
+		case queryIs(query, "INSERT INTO audit_log"):
+			return fakeResult{}, errors.New("simulated failure")
+		}
+		return fakeResult{affected: 1}, nil
+	})
+
+	w := serve(func(r *gin.Engine) { r.DELETE("/albums/:id", deleteAlbum) },
+		httptest.NewRequest(http.MethodDelete, "/albums/7", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if applied := fdb.appliedStatements(); len(applied) != 0 {
+		t.Errorf("statements applied despite the failure: %q", applied)
+	}
+	if !fdb.hasEvent("rollback") || fdb.hasEvent("commit") {
+		t.Errorf("transaction was not rolled back: %v", fdb.events)
+	}
+}
+
+func TestDeleteAlbumCommits(t *testing.T) {
+	fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+
+	w := serve(func(r *gin.Engine) { r.DELETE("/albums/:id", deleteAlbum) },
+		httptest.NewRequest(http.MethodDelete, "/albums/7", nil))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if applied := fdb.appliedStatements(); len(applied) != 3 {
+		t.Errorf("applied %d statements, want the delete, change marker and audit entry: %q", len(applied), applied)
+	}
+}
+
+// pngImage returns a small encoded PNG
+func pngImage(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// albumUpload builds a multipart album upload request
+func albumUpload(t *testing.T, method, target string, fields map[string]string, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("image", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+	req := httptest.NewRequest(method, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestAlbumIDAbove32Bits(t *testing.T) {
+	const bigID = int64(1)<<31 + 12345
+	row := []driver.Value{bigID, "Artist", "Title", int64(1999), nil, "cover.png", int64(1), nil, nil, nil, nil}
+	useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		switch {
+		case queryIs(query, "INSERT INTO Albums"):
+			return fakeResult{lastID: bigID}, nil
+		case queryIs(query, "SELECT COUNT(*)"):
+			return fakeResult{rows: [][]driver.Value{{int64(1)}}}, nil
+		case queryIs(query, "SELECT UNIX_TIMESTAMP(MAX(updated_at))"):
+			return fakeResult{rows: [][]driver.Value{{nil}}}, nil
+		case queryIs(query, "SELECT "+albumSummaryColumns+", image FROM Albums WHERE id = ?"):
+			if args[0].Value != bigID {
+				return fakeResult{}, nil
+			}
+			return fakeResult{rows: [][]driver.Value{append(row, []byte("img"))}}, nil
+		case queryIs(query, "SELECT "+albumSummaryColumns+" FROM Albums"):
+			return fakeResult{rows: [][]driver.Value{row}}, nil
+		case queryIs(query, "SELECT"):
+			return fakeResult{}, nil
+		}
+		return fakeResult{affected: 1}, nil
+	})
+	register := func(r *gin.Engine) {
+		r.POST("/albums", createAlbum)
+		r.GET("/albums/:id", getAlbum)
+		r.GET("/albums", listAlbums)
+	}
+
+	w := serve(register, albumUpload(t, http.MethodPost, "/albums",
+		map[string]string{"artist": "Artist", "title": "Title", "year": "1999"}, "cover.png", pngImage(t)))
+	var created struct{ AlbumID int64 }
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", w.Code, w.Body)
+	}
+	if created.AlbumID != bigID {
+		t.Errorf("create returned ID %d, want %d", created.AlbumID, bigID)
+	}
+
+	w = serve(register, httptest.NewRequest(http.MethodGet, "/albums/"+strconv.FormatInt(bigID, 10), nil))
+	var album Album
+	if err := json.Unmarshal(w.Body.Bytes(), &album); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("get: status %d, body %s", w.Code, w.Body)
+	}
+	if album.ID != bigID {
+		t.Errorf("get returned ID %d, want %d", album.ID, bigID)
+	}
+
+	w = serve(register, httptest.NewRequest(http.MethodGet, "/albums", nil))
+	var page struct{ Data []Album }
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list: status %d, body %s", w.Code, w.Body)
+	}
+	if len(page.Data) != 1 || page.Data[0].ID != bigID {
+		t.Errorf("list returned %+v, want one album with ID %d", page.Data, bigID)
+	}
+}
+
+func TestPrepareThumbnailRecompressesOnlyWhenAsked(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+	prev := cfg.RecompressAbove
+	cfg.RecompressAbove = len(original) / 2
+	t.Cleanup(func() { cfg.RecompressAbove = prev })
+
+	kept := &albumInput{filename: "cover.jpg", image: original}
+	kept.prepareThumbnail()
+	if !bytes.Equal(kept.image, original) {
+		t.Error("image was recompressed without recompress set")
+	}
+
+	shrunk := &albumInput{filename: "cover.jpg", image: original, recompress: true}
+	shrunk.prepareThumbnail()
+	if len(shrunk.image) >= len(original) {
+		t.Errorf("recompressed image is %d bytes, original %d", len(shrunk.image), len(original))
+	}
+}
+
+func TestGetAlbumImageFormats(t *testing.T) {
+	stored := pngImage(t)
+	useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		return fakeResult{rows: [][]driver.Value{{"cover.png", stored, nil}}}, nil
+	})
+
+	for format, want := range map[string]int{
+		"png":  http.StatusOK,
+		"jpeg": http.StatusOK,
+		"webp": http.StatusUnsupportedMediaType,
+		"gif":  http.StatusBadRequest,
+	} {
+		w := serve(func(r *gin.Engine) { r.GET("/albums/:id/image", getAlbumImage) },
+			httptest.NewRequest(http.MethodGet, "/albums/1/image?format="+format, nil))
+		if w.Code != want {
+			t.Errorf("format=%s: status = %d, want %d", format, w.Code, want)
+		}
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	tests := []struct {
+		name       string
+		filename   string
+		data       []byte
+		wantStatus int
+	}{
+		{"valid", "cover.png", pngImage(t), http.StatusOK},
+		{"content does not match extension", "cover.jpg", pngImage(t), http.StatusUnprocessableEntity},
+		{"not an image", "cover.png", []byte("not an image"), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(func(r *gin.Engine) { r.POST("/images/validate", validateImage) },
+				albumUpload(t, http.MethodPost, "/images/validate", nil, tt.filename, tt.data))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestReplaceAlbumImageRejectsInvalidImages(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("note", "no image")
+	mw.Close()
+	missing := httptest.NewRequest(http.MethodPut, "/albums/1/image", &body)
+	missing.Header.Set("Content-Type", mw.FormDataContentType())
+
+	for name, req := range map[string]*http.Request{
+		"missing image": missing,
+		"not an image":  albumUpload(t, http.MethodPut, "/albums/1/image", nil, "cover.png", []byte("not an image")),
+	} {
+		req.Header.Set("If-Match", `"etag"`)
+		w := serve(func(r *gin.Engine) { r.PUT("/albums/:id/image", replaceAlbumImage) }, req)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d, want %d (body %s)", name, w.Code, http.StatusUnprocessableEntity, w.Body)
+		}
+	}
+}
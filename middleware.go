@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRequestSize caps every request body at limit bytes. Bodies that declare a
+// larger Content-Length are refused up front; others fail on the first read
+// past the limit, which handlers report through isBodyTooLarge.
+func maxRequestSize(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// isBodyTooLarge reports whether err came from reading past the body limit
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// requestLogger writes one access log line per request. Successful responses
+// are sampled at LOG_SAMPLE_RATE; non-2xx responses, requests that recorded
+// errors and requests slower than SLOW_REQUEST_MS are always logged.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start)
+
+		if clientGone(c) {
+			debugf("Client disconnected: %s %s after %v id=%s",
+				c.Request.Method, c.Request.URL.Path, latency, c.GetString("requestID"))
+			return
+		}
+
+		status := c.Writer.Status()
+		if size, ok := c.Get("uploadBytes"); ok && latency >= cfg.SlowUploadThreshold {
+			logSlowUpload(c, status, latency, size.(int))
+		}
+		slow := latency >= cfg.SlowRequestThreshold
+		success := status >= 200 && status < 300
+		if success && !slow && len(c.Errors) == 0 && rand.Float64() >= cfg.LogSampleRate {
+			return
+		}
+
+		line := fmt.Sprintf("%s %s %d %v %s id=%s",
+			c.Request.Method, c.Request.URL.Path, status, latency, c.ClientIP(), c.GetString("requestID"))
+		if slow {
+			line += " SLOW"
+		}
+		if len(c.Errors) > 0 {
+			line += " " + c.Errors.String()
+		}
+		log.Print(line)
+	}
+}
+
+// debugf logs only when LOG_LEVEL is debug
+func debugf(format string, args ...any) {
+	if cfg.DebugLogging {
+		log.Printf(format, args...)
+	}
+}
+
+// clientGone reports whether the request's client disconnected. Its context
+// is cancelled then, which aborts the DB calls made with it.
+func clientGone(c *gin.Context) bool {
+	return errors.Is(c.Request.Context().Err(), context.Canceled)
+}
+
+// skipCanceledResponses discards whatever a handler writes once its client
+// has disconnected. Handlers see the cancellation as an error from their DB
+// calls and answer as for any other failure; dropping that answer here keeps
+// it out of recentErrors, and requestLogger notes the disconnect at debug
+// level instead of logging a server error.
+func skipCanceledResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = &canceledWriter{ResponseWriter: c.Writer, c: c}
+		c.Next()
+	}
+}
+
+// canceledWriter drops the status and body once clientGone
+type canceledWriter struct {
+	gin.ResponseWriter
+	c *gin.Context
+}
+
+func (w *canceledWriter) WriteHeader(code int) {
+	if !clientGone(w.c) {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *canceledWriter) WriteHeaderNow() {
+	if !clientGone(w.c) {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *canceledWriter) Write(b []byte) (int, error) {
+	if clientGone(w.c) {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *canceledWriter) WriteString(s string) (int, error) {
+	if clientGone(w.c) {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// slowUpload is the structured log entry for an upload slower than
+// SLOW_UPLOAD_MS, carrying the image size so duration can be plotted
+// against it
+type slowUpload struct {
+	Level      string  `json:"level"`
+	Msg        string  `json:"msg"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	ImageBytes int     `json:"imageBytes"`
+	RequestID  string  `json:"requestId"`
+}
+
+// logSlowUpload writes a slowUpload entry as one JSON line
+func logSlowUpload(c *gin.Context, status int, latency time.Duration, size int) {
+	line, err := json.Marshal(slowUpload{Level: "warn", Msg: "slow upload", Method: c.Request.Method,
+		Path: c.Request.URL.Path, Status: status, DurationMs: float64(latency.Microseconds()) / 1000,
+		ImageBytes: size, RequestID: c.GetString("requestID")})
+	if err != nil {
+		return
+	}
+	log.Print(string(line))
+}
+
+// recordUploadSize notes the size of the image a request uploaded, for
+// requestLogger's slow upload entries
+func recordUploadSize(c *gin.Context, size int) {
+	c.Set("uploadBytes", size)
+}
+
+// shedOnPoolSaturation fails requests fast with 503 once the connection pool
+// is exhausted and more than maxWaiters other requests are already queued
+// for it. database/sql doesn't expose its current waiters, so they are
+// estimated as the in-flight requests beyond the connections in use, not
+// counting event streams; nearly every other route touches the database,
+// which keeps the estimate close.
+func shedOnPoolSaturation(maxWaiters int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Before startup finishes only the health routes get this far, and
+		// the pool may not exist yet
+		if !ready.Load() {
+			c.Next()
+			return
+		}
+		stats := db.Stats()
+		if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+			// Exclude this request from the count
+			waiting := inFlight.Load() - 1 - openStreams.Load() - int64(stats.InUse)
+			if waiting > int64(maxWaiters) {
+				c.Header("Retry-After", "1")
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Database is busy, please retry"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// overridableMethods are the methods a POST may ask to be treated as
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// methodOverride lets clients behind proxies that block PUT, PATCH and
+// DELETE send them as a POST carrying X-HTTP-Method-Override. It wraps the
+// engine rather than being gin middleware because gin picks the route before
+// any middleware runs.
+func methodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && r.Method == http.MethodPost {
+			method := strings.ToUpper(strings.TrimSpace(override))
+			if overridableMethods[method] {
+				log.Printf("Method override: POST %s handled as %s", r.URL.Path, method)
+				r.Method = method
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientWrites counts the write requests each client has in progress
+var clientWrites = struct {
+	sync.Mutex
+	active map[string]int
+}{active: make(map[string]int)}
+
+// limitClientWrites allows each client at most limit concurrent requests
+// through, answering 429 beyond that. Clients are told apart the way the
+// audit log does, by valid API key or else by IP, so inventing keys doesn't
+// buy extra slots. A limit of 0 or less disables the check.
+func limitClientWrites(limit int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+
+		client := requestActor(c)
+		clientWrites.Lock()
+		if clientWrites.active[client] >= limit {
+			clientWrites.Unlock()
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many concurrent uploads"})
+			return
+		}
+		clientWrites.active[client]++
+		clientWrites.Unlock()
+
+		// Deferred so the slot is returned even if the handler panics
+		defer func() {
+			clientWrites.Lock()
+			if clientWrites.active[client]--; clientWrites.active[client] == 0 {
+				delete(clientWrites.active, client)
+			}
+			clientWrites.Unlock()
+		}()
+		c.Next()
+	}
+}
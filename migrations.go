@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// backfillBatchSize is how many rows a backfill reads and rewrites at a time
+const backfillBatchSize = 500
+
+// migration is a single, ordered schema change. Statements run first, then
+// the optional backfill for data changes that are easier to express in Go.
+// MySQL commits DDL implicitly, so keep each migration to one step that is
+// safe to re-run if the process dies before it is recorded.
+type migration struct {
+	version     int
+	description string
+	stmts       []string
+	backfill    func(ctx context.Context, conn *sql.Conn) error
+}
+
+// migrations lists every schema change in the order it must be applied.
+// Never edit an entry once it has shipped; append a new one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create Albums table",
+		stmts: []string{`
+			CREATE TABLE IF NOT EXISTS Albums (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				artist VARCHAR(255) NOT NULL,
+				year INT NOT NULL,
+				title VARCHAR(255) NOT NULL,
+				image MEDIUMBLOB NOT NULL
+			) ENGINE=InnoDB`,
+		},
+	},
+	{
+		version:     2,
+		description: "add filename column",
+		stmts: []string{
+			`ALTER TABLE Albums ADD COLUMN filename VARCHAR(255) NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     3,
+		description: "add version column for optimistic locking",
+		stmts: []string{
+			`ALTER TABLE Albums ADD COLUMN version INT NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		version:     4,
+		description: "add thumbnail columns",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN thumbnail MEDIUMBLOB NULL,
+				ADD COLUMN thumbnail_spec VARCHAR(32) NULL`,
+		},
+	},
+	{
+		version:     5,
+		description: "widen album id to BIGINT",
+		stmts: []string{
+			`ALTER TABLE Albums MODIFY id BIGINT NOT NULL AUTO_INCREMENT`,
+		},
+	},
+	{
+		version:     6,
+		description: "add normalized artist and title columns",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN artist_norm VARCHAR(255) NOT NULL DEFAULT '',
+				ADD COLUMN title_norm VARCHAR(255) NOT NULL DEFAULT '',
+				ADD INDEX idx_albums_norm (artist_norm, title_norm, year),
+				ADD INDEX idx_albums_title_norm (title_norm)`,
+		},
+	},
+	{
+		version:     7,
+		description: "backfill normalized artist and title",
+		backfill:    backfillNormalizedColumns,
+	},
+	{
+		version:     8,
+		description: "add created_at and updated_at timestamps",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				ADD INDEX idx_albums_updated_at (updated_at)`,
+		},
+	},
+	{
+		version:     9,
+		description: "create album_changes for tracking deletions",
+		stmts: []string{`
+			CREATE TABLE IF NOT EXISTS album_changes (
+				id TINYINT PRIMARY KEY,
+				last_deleted_at TIMESTAMP NOT NULL
+			) ENGINE=InnoDB`,
+		},
+	},
+	{
+		version:     10,
+		description: "create audit_log",
+		stmts: []string{`
+			CREATE TABLE IF NOT EXISTS audit_log (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				album_id BIGINT NOT NULL,
+				action VARCHAR(16) NOT NULL,
+				actor VARCHAR(128) NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				details JSON NULL,
+				INDEX idx_audit_log_album (album_id, id)
+			) ENGINE=InnoDB`,
+		},
+	},
+	{
+		version:     11,
+		description: "rebuild normalized columns with whitespace collapsed",
+		backfill:    backfillNormalizedColumns,
+	},
+	{
+		version:     12,
+		description: "add track count and duration columns",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN track_count INT NULL,
+				ADD COLUMN duration_seconds INT NULL`,
+		},
+	},
+	{
+		version:     13,
+		description: "add view_count column",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN view_count BIGINT NOT NULL DEFAULT 0,
+				ADD INDEX idx_albums_view_count (view_count)`,
+		},
+	},
+	{
+		version:     14,
+		description: "add image_hash column",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN image_hash CHAR(64) NULL,
+				ADD INDEX idx_albums_image_hash (image_hash)`,
+		},
+	},
+	{
+		version:     15,
+		description: "backfill image_hash",
+		backfill:    backfillImageHashes,
+	},
+	{
+		version:     16,
+		description: "add artist and year indexes",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD INDEX idx_albums_artist (artist),
+				ADD INDEX idx_albums_year (year),
+				ADD INDEX idx_albums_artist_year (artist, year)`,
+		},
+	},
+	{
+		version:     17,
+		description: "add upc and isrc codes",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN upc VARCHAR(32) NULL,
+				ADD COLUMN isrc VARCHAR(32) NULL,
+				ADD UNIQUE INDEX idx_albums_upc (upc),
+				ADD UNIQUE INDEX idx_albums_isrc (isrc)`,
+		},
+	},
+	{
+		version:     18,
+		description: "add image_phash",
+		stmts: []string{
+			"ALTER TABLE Albums ADD COLUMN image_phash BIGINT NULL",
+		},
+	},
+	{
+		version:     19,
+		description: "add year_text for fuzzy years",
+		stmts: []string{
+			"ALTER TABLE Albums ADD COLUMN year_text VARCHAR(32) NULL",
+		},
+	},
+	{
+		version:     20,
+		description: "index created_at for date range listings",
+		stmts: []string{
+			"ALTER TABLE Albums ADD INDEX idx_albums_created_at (created_at)",
+		},
+	},
+	{
+		// Kept apart from 18 so a failed backfill leaves the column's
+		// migration recorded; backfillImagePHashes resumes from unhashed rows
+		version:     21,
+		description: "backfill image_phash",
+		backfill:    backfillImagePHashes,
+	},
+	{
+		version:     22,
+		description: "add upsert_canonical for PUT /albums",
+		stmts: []string{
+			`ALTER TABLE Albums
+				ADD COLUMN upsert_canonical TINYINT NULL,
+				ADD UNIQUE INDEX idx_albums_upsert (artist_norm, title_norm, year, upsert_canonical)`,
+		},
+	},
+	{
+		version:     23,
+		description: "mark the oldest album of each artist, title and year for upserts",
+		stmts: []string{
+			`UPDATE Albums a
+				JOIN (SELECT MIN(id) AS id FROM Albums GROUP BY artist_norm, title_norm, year) oldest ON a.id = oldest.id
+				SET a.upsert_canonical = 1, a.updated_at = a.updated_at`,
+		},
+	},
+}
+
+// runMigrations applies any migrations not yet recorded in schema_migrations
+func runMigrations() error {
+	ctx := context.Background()
+
+	// Use a single connection so the advisory lock covers every statement
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Close()
+
+	// Serialize migrations across instances starting at the same time
+	var locked int
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK('albums_migrations', 60)").Scan(&locked); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	if locked != 1 {
+		return fmt.Errorf("timed out waiting for migration lock")
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK('albums_migrations')")
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			description VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return fmt.Errorf("read schema_migrations: %w", err)
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return fmt.Errorf("read schema_migrations: %w", err)
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		for _, stmt := range m.stmts {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+			}
+		}
+		if m.backfill != nil {
+			if err := m.backfill(ctx, conn); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+			}
+		}
+		_, err := conn.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version, description) VALUES (?, ?)",
+			m.version, m.description)
+		if err != nil {
+			return fmt.Errorf("record migration %d: %w", m.version, err)
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.description)
+	}
+
+	return nil
+}
+
+// backfillNormalizedColumns fills artist_norm and title_norm for every row
+// using the same matchKey the write path applies
+func backfillNormalizedColumns(ctx context.Context, conn *sql.Conn) error {
+	var lastID int64
+	for {
+		rows, err := conn.QueryContext(ctx,
+			"SELECT id, artist, title FROM Albums WHERE id > ? ORDER BY id LIMIT ?",
+			lastID, backfillBatchSize)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id            int64
+			artist, title string
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.artist, &r.title); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, r := range batch {
+			_, err := conn.ExecContext(ctx,
+				"UPDATE Albums SET artist_norm = ?, title_norm = ? WHERE id = ?",
+				matchKey(r.artist), matchKey(r.title), r.id)
+			if err != nil {
+				return err
+			}
+		}
+		lastID = batch[len(batch)-1].id
+	}
+}
+
+// imageBackfillBatchSize is smaller than backfillBatchSize because each row
+// carries a full image
+const imageBackfillBatchSize = 50
+
+// backfillImageHashes fills image_hash for rows stored before it existed
+func backfillImageHashes(ctx context.Context, conn *sql.Conn) error {
+	var lastID int64
+	for {
+		rows, err := conn.QueryContext(ctx,
+			"SELECT id, image FROM Albums WHERE id > ? AND image_hash IS NULL ORDER BY id LIMIT ?",
+			lastID, imageBackfillBatchSize)
+		if err != nil {
+			return err
+		}
+		hashes := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var image []byte
+			if err := rows.Scan(&id, &image); err != nil {
+				rows.Close()
+				return err
+			}
+			hashes[id] = imageHash(image)
+			lastID = max(lastID, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(hashes) == 0 {
+			return nil
+		}
+
+		for id, hash := range hashes {
+			_, err := conn.ExecContext(ctx,
+				"UPDATE Albums SET image_hash = ?, updated_at = updated_at WHERE id = ?", hash, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// expectedIndexes lists the Albums indexes the read paths and upserts depend
+// on. A missing one is only warned about: reads still work, just slowly,
+// but without idx_albums_upsert every PUT /albums inserts a new album.
+var expectedIndexes = []string{
+	"idx_albums_norm",
+	"idx_albums_title_norm",
+	"idx_albums_updated_at",
+	"idx_albums_view_count",
+	"idx_albums_image_hash",
+	"idx_albums_artist",
+	"idx_albums_year",
+	"idx_albums_artist_year",
+	"idx_albums_upc",
+	"idx_albums_isrc",
+	"idx_albums_created_at",
+	"idx_albums_upsert",
+}
+
+// verifyIndexes warns about any of expectedIndexes missing from Albums, for
+// example after someone dropped one by hand
+func verifyIndexes() error {
+	rows, err := db.Query(`SELECT DISTINCT index_name FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'Albums'`)
+	if err != nil {
+		return fmt.Errorf("read index list: %w", err)
+	}
+	defer rows.Close()
+
+	present := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("read index list: %w", err)
+		}
+		present[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read index list: %w", err)
+	}
+
+	for _, name := range expectedIndexes {
+		if !present[name] {
+			log.Printf("WARNING: index %s is missing on Albums; queries relying on it will scan the table", name)
+		}
+	}
+	return nil
+}
+
+// mediumBlobMaxBytes is the largest value a MEDIUMBLOB column holds
+const mediumBlobMaxBytes = 1<<24 - 1
+
+// checkImageColumn widens Albums.image to LONGBLOB when LARGE_IMAGES is set,
+// and otherwise caps MAX_IMAGE_BYTES at what the MEDIUMBLOB column can hold,
+// so oversized images are refused with a clear 400 up front instead of
+// failing at INSERT. Widening is a table rebuild, so it is opt-in rather than
+// a versioned migration, and it happens at most once.
+func checkImageColumn() error {
+	var dataType string
+	query := `SELECT DATA_TYPE FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'Albums' AND COLUMN_NAME = 'image'`
+	if err := db.QueryRow(query).Scan(&dataType); err != nil {
+		return err
+	}
+	if dataType != "mediumblob" {
+		return nil
+	}
+
+	if cfg.LargeImages {
+		log.Printf("Widening Albums.image to LONGBLOB for LARGE_IMAGES")
+		_, err := db.Exec("ALTER TABLE Albums MODIFY image LONGBLOB NOT NULL")
+		return err
+	}
+	if cfg.MaxImageBytes > mediumBlobMaxBytes {
+		log.Printf("MAX_IMAGE_BYTES=%d exceeds the MEDIUMBLOB image column; capping at %d (set LARGE_IMAGES=true to widen it)",
+			cfg.MaxImageBytes, mediumBlobMaxBytes)
+		cfg.MaxImageBytes = mediumBlobMaxBytes
+	}
+	return nil
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	AppliedAt   time.Time `json:"appliedAt"`
+	// Known is false for versions this binary has no migration for, which
+	// means a newer build has migrated the database
+	Known bool `json:"known"`
+}
+
+// DebugMigrations compares the schema versions recorded in the database
+// with the migrations built into this binary, to confirm after a deploy that
+// the two match
+func debugMigrations(c *gin.Context) {
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.version] = true
+	}
+
+	rows, err := readQuery(c.Request.Context(), "SELECT version, description, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	applied := []appliedMigration{}
+	done := make(map[int]bool)
+	current := 0
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Description, &m.AppliedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		m.Known = known[m.Version]
+		applied = append(applied, m)
+		done[m.Version] = true
+		current = max(current, m.Version)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	pending := []int{}
+	for _, m := range migrations {
+		if !done[m.version] {
+			pending = append(pending, m.version)
+		}
+	}
+	latest := migrations[len(migrations)-1].version
+	c.JSON(http.StatusOK, gin.H{
+		"currentVersion": current,
+		"binaryVersion":  latest,
+		"upToDate":       len(pending) == 0 && current == latest,
+		"pending":        pending,
+		"applied":        applied,
+	})
+}
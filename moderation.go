@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// artistDenylist holds artist names rejected on create, as match keys so
+// case and spacing variants are caught too
+type artistDenylist struct {
+	entries   []string
+	substring bool
+}
+
+// loadArtistDenylist combines the comma-separated names in listKey with the
+// file named by fileKey, one name per line, skipping blanks and # comments.
+// modeKey selects "exact" (the default) or "substring" matching.
+func loadArtistDenylist(listKey, fileKey, modeKey string) artistDenylist {
+	var names []string
+	names = append(names, envList(listKey, nil)...)
+	if path := os.Getenv(fileKey); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", fileKey, err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, line)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", fileKey, err)
+		}
+	}
+
+	var list artistDenylist
+	switch mode := envString(modeKey, "exact"); mode {
+	case "exact":
+	case "substring":
+		list.substring = true
+	default:
+		log.Printf("Ignoring invalid %s=%q: must be exact or substring", modeKey, mode)
+	}
+	for _, name := range names {
+		if key := matchKey(name); key != "" {
+			list.entries = append(list.entries, key)
+		}
+	}
+	if len(list.entries) > 0 {
+		log.Printf("Artist denylist: %d entries, substring=%t", len(list.entries), list.substring)
+	}
+	return list
+}
+
+// MarshalJSON summarizes the list for /debug/config
+func (l artistDenylist) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{"entries": len(l.entries), "substring": l.substring})
+}
+
+// denies reports whether artist matches an entry of the list
+func (l artistDenylist) denies(artist string) bool {
+	key := matchKey(artist)
+	for _, entry := range l.entries {
+		if key == entry || l.substring && strings.Contains(key, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// errArtistDenied fails writes, such as import entries and patches, whose
+// artist turns out to be on the denylist only once they are parsed
+var errArtistDenied = &validationError{"Artist is not allowed"}
+
+// rejectDeniedArtist answers 403 and logs the attempt for review when artist
+// is on the denylist, returning true if it did
+func rejectDeniedArtist(c *gin.Context, artist string) bool {
+	if !cfg.ArtistDenylist.denies(artist) {
+		return false
+	}
+	log.Printf("Rejected album for denylisted artist %q from %s (request %s)", artist, requestActor(c), c.GetString("requestID"))
+	c.JSON(http.StatusForbidden, gin.H{"error": "Artist is not allowed"})
+	return true
+}
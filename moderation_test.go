@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeniedArtistRejectedOnEveryWrite(t *testing.T) {
+	prev := cfg.ArtistDenylist
+	cfg.ArtistDenylist = artistDenylist{entries: []string{matchKey("Banned Band")}}
+	t.Cleanup(func() { cfg.ArtistDenylist = prev })
+
+	row := []driver.Value{int64(1), "Someone", "Title", int64(1999), nil, "cover.png", int64(1), nil, nil, nil, nil}
+	fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		if queryIs(query, "SELECT") {
+			return fakeResult{rows: [][]driver.Value{row}}, nil
+		}
+		return fakeResult{affected: 1, lastID: 1}, nil
+	})
+
+	bundle, _ := json.Marshal(albumBundle{Format: albumBundleFormat, Artist: "Banned Band", Title: "T", Year: 1999,
+		Filename: "cover.png", Image: pngImage(t)})
+	jsonRequest := func(method, target, contentType, body string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	requests := map[string]*http.Request{
+		"create": albumUpload(t, http.MethodPost, "/albums",
+			map[string]string{"artist": "Banned Band", "title": "T", "year": "1999"}, "cover.png", pngImage(t)),
+		"update": jsonRequest(http.MethodPut, "/albums/1", "application/json",
+			`{"artist": "Banned Band", "title": "T", "year": 1999}`),
+		"patch": jsonRequest(http.MethodPatch, "/albums/1", jsonPatchContentType,
+			`[{"op": "replace", "path": "/artist", "value": "banned band"}]`),
+		"import": jsonRequest(http.MethodPost, "/albums/import", "application/json", string(bundle)),
+	}
+	register := func(r *gin.Engine) {
+		r.POST("/albums", createAlbum)
+		r.PUT("/albums/:id", updateAlbum)
+		r.PATCH("/albums/:id", patchAlbum)
+		r.POST("/albums/import", importAlbum)
+	}
+	for name, req := range requests {
+		t.Run(name, func(t *testing.T) {
+			if w := serve(register, req); w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d (body %s)", w.Code, http.StatusForbidden, w.Body)
+			}
+		})
+	}
+	if applied := fdb.appliedStatements(); len(applied) != 0 {
+		t.Errorf("statements applied for a denied artist: %q", applied)
+	}
+}
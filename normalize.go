@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cleanField tidies a user-supplied artist or title before it is stored:
+// surrounding whitespace is dropped, internal runs of whitespace become a
+// single space and, with NORMALIZE_TITLE_CASE, each word is capitalized
+func cleanField(s string) string {
+	s = collapseSpaces(s)
+	if cfg.NormalizeTitleCase {
+		s = titleCase(s)
+	}
+	return s
+}
+
+// matchKey is the form of an artist or title used when comparing albums for
+// equality, so that "The  Beatles " and "the beatles" are the same artist
+func matchKey(s string) string {
+	return strings.ToLower(collapseSpaces(s))
+}
+
+// collapseSpaces trims s and replaces each run of whitespace with one space
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// titleCase upper-cases the first letter of each space-separated word. The
+// rest of each word is left alone so names like "McCartney" or "AC/DC"
+// survive.
+func titleCase(s string) string {
+	words := strings.Split(s, " ")
+	for i, w := range words {
+		r, size := utf8.DecodeRuneInString(w)
+		if unicode.IsLower(r) {
+			words[i] = string(unicode.ToUpper(r)) + w[size:]
+		}
+	}
+	return strings.Join(words, " ")
+}
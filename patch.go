@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jsonPatchContentType is the media type of an RFC 6902 patch document
+const jsonPatchContentType = "application/json-patch+json"
+
+// jsonPatchOp is a single operation in an RFC 6902 patch document
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// albumPatchDoc is the JSON document a patch is applied to: the album's
+// metadata keyed by JSON member name
+type albumPatchDoc map[string]json.RawMessage
+
+// patchableFields are the members a patch may change. id and version can
+// only be tested; the image is not part of the document at all.
+var patchableFields = map[string]bool{
+	"artist": true, "title": true, "year": true, "trackCount": true, "durationSeconds": true,
+	"upc": true, "isrc": true,
+}
+
+// optionalFields may be removed, which clears them
+var optionalFields = map[string]bool{"trackCount": true, "durationSeconds": true, "upc": true, "isrc": true}
+
+// newAlbumPatchDoc builds the patch document for album
+func newAlbumPatchDoc(album *Album) albumPatchDoc {
+	doc := make(albumPatchDoc)
+	for name, v := range map[string]any{
+		"id": album.ID, "artist": album.Artist, "title": album.Title,
+		"year": album.Year, "filename": album.Filename, "version": album.Version,
+		"trackCount": album.TrackCount, "durationSeconds": album.DurationSeconds,
+		"upc": album.UPC, "isrc": album.ISRC,
+	} {
+		doc[name], _ = json.Marshal(v)
+	}
+	return doc
+}
+
+// member maps a JSON pointer to a top-level member of the document
+func (doc albumPatchDoc) member(pointer string) (string, error) {
+	name, ok := strings.CutPrefix(pointer, "/")
+	if !ok || strings.Contains(name, "/") {
+		return "", &validationError{fmt.Sprintf("Unsupported patch path %q", pointer)}
+	}
+	name = strings.NewReplacer("~1", "/", "~0", "~").Replace(name)
+	if name == "image" {
+		return "", &validationError{"The image cannot be changed with a patch"}
+	}
+	if _, ok := doc[name]; !ok {
+		return "", &validationError{fmt.Sprintf("Unknown patch path %q", pointer)}
+	}
+	return name, nil
+}
+
+// writable resolves a pointer that an operation is about to modify
+func (doc albumPatchDoc) writable(pointer string) (string, error) {
+	name, err := doc.member(pointer)
+	if err != nil {
+		return "", err
+	}
+	if !patchableFields[name] {
+		return "", &validationError{fmt.Sprintf("Field %q cannot be modified", name)}
+	}
+	return name, nil
+}
+
+// apply runs ops against the document in order, stopping at the first
+// failure as RFC 6902 requires
+func (doc albumPatchDoc) apply(ops []jsonPatchOp) error {
+	for i, op := range ops {
+		if err := doc.applyOp(op); err != nil {
+			return &validationError{fmt.Sprintf("Patch operation %d: %v", i, err)}
+		}
+	}
+	return nil
+}
+
+func (doc albumPatchDoc) applyOp(op jsonPatchOp) error {
+	switch op.Op {
+	case "add", "replace":
+		// Every member always exists, so add behaves like replace
+		name, err := doc.writable(op.Path)
+		if err != nil {
+			return err
+		}
+		if op.Value == nil {
+			return errors.New("value is required")
+		}
+		doc[name] = op.Value
+	case "remove":
+		name, err := doc.writable(op.Path)
+		if err != nil {
+			return err
+		}
+		if !optionalFields[name] {
+			return errors.New("artist, title, and year are required and cannot be removed")
+		}
+		doc[name] = json.RawMessage("null")
+	case "move", "copy":
+		from, err := doc.member(op.From)
+		if err != nil {
+			return err
+		}
+		name, err := doc.writable(op.Path)
+		if err != nil {
+			return err
+		}
+		if op.Op == "move" && from != name {
+			if _, err := doc.writable(op.From); err != nil {
+				return err
+			}
+			if !optionalFields[from] {
+				return errors.New("artist, title, and year are required and cannot be moved away")
+			}
+			doc[name], doc[from] = doc[from], json.RawMessage("null")
+			return nil
+		}
+		doc[name] = doc[from]
+	case "test":
+		name, err := doc.member(op.Path)
+		if err != nil {
+			return err
+		}
+		var want, got any
+		if err := json.Unmarshal(op.Value, &want); err != nil {
+			return errors.New("value is required")
+		}
+		json.Unmarshal(doc[name], &got)
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("test failed for %s", op.Path)
+		}
+	default:
+		return fmt.Errorf("unsupported op %q", op.Op)
+	}
+	return nil
+}
+
+// patchTypeError is a patched member whose value has the wrong JSON type.
+// Like any other body that doesn't parse, it answers 400 rather than 422.
+type patchTypeError struct {
+	field string
+}
+
+func (e *patchTypeError) Error() string {
+	return fmt.Sprintf("Field %q has the wrong type", e.field)
+}
+
+// decodeInto stores the document's metadata back into album, rejecting
+// values of the wrong type and nulls in required fields, which decoding
+// would otherwise skip
+func (doc albumPatchDoc) decodeInto(album *Album) error {
+	year := album.Year
+	for name, dst := range map[string]any{
+		"artist": &album.Artist, "title": &album.Title, "year": &album.Year,
+		"trackCount": &album.TrackCount, "durationSeconds": &album.DurationSeconds,
+		"upc": &album.UPC, "isrc": &album.ISRC,
+	} {
+		if !optionalFields[name] && bytes.Equal(bytes.TrimSpace(doc[name]), []byte("null")) {
+			return &validationError{fmt.Sprintf("Field %q is required and cannot be null", name)}
+		}
+		dec := json.NewDecoder(bytes.NewReader(doc[name]))
+		if err := dec.Decode(dst); err != nil {
+			return &patchTypeError{name}
+		}
+	}
+	album.Artist, album.Title = cleanField(album.Artist), cleanField(album.Title)
+	// A year set through the patch is exact
+	if album.Year != year {
+		album.YearText = nil
+	}
+	if err := validateAlbumFields(album.Artist, album.Title, album.Year); err != nil {
+		return err
+	}
+	if err := validateAlbumDetails(album.TrackCount, album.DurationSeconds); err != nil {
+		return err
+	}
+	var err error
+	album.UPC, album.ISRC, err = normalizeAlbumCodes(album.UPC, album.ISRC)
+	return err
+}
+
+// PatchAlbum applies an RFC 6902 JSON patch to an album's metadata. The
+// patch runs against the row as locked inside the transaction, so a "test"
+// on /version gives the same protection as If-Match.
+func patchAlbum(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType != jsonPatchContentType {
+		c.Header("Accept-Patch", jsonPatchContentType)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be " + jsonPatchContentType})
+		return
+	}
+
+	var ops []jsonPatchOp
+	if err := newJSONDecoder(c.Request.Body).Decode(&ops); err != nil {
+		if isBodyTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		} else if field, ok := unknownJSONField(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown patch operation member " + field})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Patch must be a JSON array of operations"})
+		}
+		return
+	}
+
+	expected, conditional, err := parseVersionTag(c.GetHeader("If-Match"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match must be an album version"})
+		return
+	}
+
+	actor := requestActor(c)
+	var album Album
+	err = withTx(c.Request.Context(), func(tx *sql.Tx) error {
+		query := "SELECT " + albumSummaryColumns + " FROM Albums WHERE id = ? FOR UPDATE"
+		err := tx.QueryRow(query, albumID).Scan(album.summaryDest()...)
+		if err == sql.ErrNoRows {
+			return errAlbumNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if conditional && expected != album.Version {
+			return errVersionConflict
+		}
+
+		doc := newAlbumPatchDoc(&album)
+		if err := doc.apply(ops); err != nil {
+			return err
+		}
+		if err := doc.decodeInto(&album); err != nil {
+			return err
+		}
+		if cfg.ArtistDenylist.denies(album.Artist) {
+			return errArtistDenied
+		}
+		return writeAlbumUpdate(tx, &album, actor)
+	})
+	var invalid *validationError
+	var wrongType *patchTypeError
+	if errors.Is(err, errArtistDenied) {
+		rejectDeniedArtist(c, album.Artist)
+		return
+	} else if errors.Is(err, errAlbumNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if errors.Is(err, errVersionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Album was modified concurrently", "version": album.Version})
+		return
+	} else if errors.As(err, &wrongType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": wrongType.Error()})
+		return
+	} else if errors.As(err, &invalid) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": invalid.msg})
+		return
+	} else if err != nil {
+		respondTxError(c, err, "Failed to update album")
+		return
+	}
+	invalidateCard(album.ID)
+	publishAlbumEvent(albumEvent{Type: auditUpdate, AlbumID: album.ID, Album: &album})
+
+	c.Header("ETag", strconv.Quote(strconv.Itoa(album.Version)))
+	c.JSON(http.StatusOK, album)
+}
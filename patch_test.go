@@ -0,0 +1,44 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPatchAlbumRejectsBadValues(t *testing.T) {
+	row := []driver.Value{int64(1), "Artist", "Title", int64(1999), nil, "cover.png", int64(1), nil, nil, nil, nil}
+	fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+		if queryIs(query, "SELECT") {
+			return fakeResult{rows: [][]driver.Value{row}}, nil
+		}
+		return fakeResult{affected: 1}, nil
+	})
+
+	tests := []struct {
+		name       string
+		patch      string
+		wantStatus int
+	}{
+		{"wrong type", `[{"op": "replace", "path": "/year", "value": "1999"}]`, http.StatusBadRequest},
+		{"null year", `[{"op": "replace", "path": "/year", "value": null}]`, http.StatusUnprocessableEntity},
+		{"null artist copied in", `[{"op": "copy", "from": "/upc", "path": "/artist"}]`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/albums/1", strings.NewReader(tt.patch))
+			req.Header.Set("Content-Type", jsonPatchContentType)
+			w := serve(func(r *gin.Engine) { r.PATCH("/albums/:id", patchAlbum) }, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+	if applied := fdb.appliedStatements(); len(applied) != 0 {
+		t.Errorf("statements applied for a rejected patch: %q", applied)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+// averageHashSize is the side of the grayscale grid an average hash is taken
+// over, giving one bit per cell
+const averageHashSize = 8
+
+// defaultSimilarImageThreshold is the Hamming distance similar-images accepts
+// when the client doesn't pick one. Resized and recompressed copies of a
+// cover typically differ in only a few bits.
+const defaultSimilarImageThreshold = 5
+
+// averageHash is the 64-bit average hash of img: the upright image is scaled
+// down to 8x8 grayscale, and each bit records whether that cell is brighter
+// than the mean. Copies of the same picture at other sizes or compression
+// levels hash to the same or nearby values, so the Hamming distance between
+// two hashes measures how alike the images look.
+func averageHash(src image.Image, orientation int) uint64 {
+	// BiLinear, unlike ApproxBiLinear, averages over every source pixel when
+	// shrinking, which keeps the hash stable under recompression
+	small := image.NewGray(image.Rect(0, 0, averageHashSize, averageHashSize))
+	draw.BiLinear.Scale(small, small.Bounds(), src, src.Bounds(), draw.Src, nil)
+	upright := applyOrientation(small, orientation)
+
+	var pixels [averageHashSize * averageHashSize]uint8
+	var sum int
+	b := upright.Bounds()
+	for y := range averageHashSize {
+		for x := range averageHashSize {
+			r, g, bl, _ := upright.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			v := uint8((r + g + bl) / 3 >> 8)
+			pixels[y*averageHashSize+x] = v
+			sum += int(v)
+		}
+	}
+	mean := sum / len(pixels)
+
+	var hash uint64
+	for i, v := range pixels {
+		if int(v) > mean {
+			hash |= 1 << i
+		}
+	}
+	return hash
+}
+
+// similarImage is one similar-images result: an album and how many bits its
+// image hash differs by
+type similarImage struct {
+	Album
+	Distance int `json:"distance"`
+}
+
+// SimilarImages lists albums whose cover looks like the given album's, by
+// the Hamming distance between their perceptual hashes, closest first. The
+// threshold query parameter is the largest distance included, from 0 for
+// identical hashes to 64.
+func similarImages(c *gin.Context) {
+	albumID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album ID"})
+		return
+	}
+	threshold := defaultSimilarImageThreshold
+	if v := c.Query("threshold"); v != "" {
+		threshold, err = strconv.Atoi(v)
+		if err != nil || threshold < 0 || threshold > 64 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold must be between 0 and 64"})
+			return
+		}
+	}
+
+	var hash sql.NullInt64
+	err = replicaQueryRow(c.Request.Context(), "SELECT image_phash FROM Albums WHERE id = ?", albumID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !hash.Valid {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Album image could not be hashed"})
+		return
+	}
+
+	// No index helps with Hamming distance, so this scans every hash; the
+	// column is small enough for that to stay cheap
+	query := "SELECT " + albumSummaryColumns + `, BIT_COUNT(image_phash ^ ?) AS distance FROM Albums
+		WHERE id <> ? AND image_phash IS NOT NULL AND BIT_COUNT(image_phash ^ ?) <= ?
+		ORDER BY distance, id
+		LIMIT ?`
+	rows, err := replicaQuery(c.Request.Context(), query, hash.Int64, albumID, hash.Int64, threshold, cfg.MaxResultRows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	matches := []similarImage{}
+	for rows.Next() {
+		var m similarImage
+		if err := rows.Scan(append(m.summaryDest(), &m.Distance)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		matches = append(matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"threshold": threshold, "albums": matches})
+}
+
+// backfillImagePHashes fills image_phash for rows stored before it existed.
+// Images that no longer decode are logged and left without a hash.
+func backfillImagePHashes(ctx context.Context, conn *sql.Conn) error {
+	var lastID int64
+	for {
+		rows, err := conn.QueryContext(ctx,
+			"SELECT id, image FROM Albums WHERE id > ? AND image_phash IS NULL ORDER BY id LIMIT ?",
+			lastID, imageBackfillBatchSize)
+		if err != nil {
+			return err
+		}
+		hashes := make(map[int64]int64)
+		scanned := 0
+		for rows.Next() {
+			var id int64
+			var data []byte
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			scanned++
+			lastID = max(lastID, id)
+			src, format, err := decodeImage(data)
+			if err != nil {
+				log.Printf("Skipping perceptual hash for album %d: %v", id, err)
+				continue
+			}
+			hashes[id] = int64(averageHash(src, imageOrientation(data, format)))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if scanned == 0 {
+			return nil
+		}
+
+		for id, hash := range hashes {
+			_, err := conn.ExecContext(ctx,
+				"UPDATE Albums SET image_phash = ?, updated_at = updated_at WHERE id = ?", hash, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
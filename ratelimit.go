@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route groups that get their own rate limit
+const (
+	rateGroupReads   = "reads"
+	rateGroupWrites  = "writes"
+	rateGroupExports = "exports"
+)
+
+// exportRoutes are the routes limited as exports rather than by method:
+// bulk reads and batch jobs that cost far more than a single lookup
+var exportRoutes = map[string]bool{
+	"/albums/:id/export":        true,
+	"/albums/import.zip":        true,
+	"/albums/batch/validate":    true,
+	"/albums/thumbnails/sprite": true,
+}
+
+// rateGroup picks the limit that applies to a request by its matched route
+func rateGroup(c *gin.Context) string {
+	if exportRoutes[c.FullPath()] {
+		return rateGroupExports
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return rateGroupReads
+	}
+	return rateGroupWrites
+}
+
+// rateLimit is the configured rate for one route group
+type rateLimit struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"`
+}
+
+// envRateLimit reads RATE_LIMIT_<GROUP>_PER_SECOND and _BURST. The burst
+// defaults to one second's worth of requests.
+func envRateLimit(group string) rateLimit {
+	prefix := "RATE_LIMIT_" + strings.ToUpper(group)
+	limit := rateLimit{PerSecond: envFloat(prefix+"_PER_SECOND", 0)}
+	limit.Burst = envInt(prefix+"_BURST", max(int(math.Ceil(limit.PerSecond)), 1))
+	return limit
+}
+
+// clientLimiter keeps one token bucket per client for a route group
+type clientLimiter struct {
+	mu      sync.Mutex
+	limit   rateLimit
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// bucket returns client's bucket, creating it full. Buckets that have had
+// time to refill completely are forgotten once a minute, since a new full
+// bucket behaves the same.
+func (l *clientLimiter) bucket(client string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > time.Minute {
+		idle := time.Duration(float64(l.limit.Burst) / l.limit.PerSecond * float64(time.Second))
+		for key, b := range l.buckets {
+			b.mu.Lock()
+			stale := now.Sub(b.last) > idle
+			b.mu.Unlock()
+			if stale {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = newTokenBucket(l.limit.PerSecond, l.limit.Burst)
+		l.buckets[client] = b
+	}
+	return b
+}
+
+// rateLimitByRoute limits each client's request rate separately for reads,
+// writes and exports, as configured by RATE_LIMIT_READS_PER_SECOND,
+// RATE_LIMIT_WRITES_PER_SECOND and RATE_LIMIT_EXPORTS_PER_SECOND with their
+// _BURST counterparts. A group with no rate set is unlimited. Clients are
+// told apart like limitClientWrites does. Over the limit the request is
+// answered 429, with Retry-After saying when that group has room again.
+func rateLimitByRoute(limits map[string]rateLimit) gin.HandlerFunc {
+	limiters := make(map[string]*clientLimiter)
+	for group, limit := range limits {
+		if limit.PerSecond > 0 {
+			limiters[group] = &clientLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+		}
+	}
+	return func(c *gin.Context) {
+		// Health checks come from the orchestrator and must always answer
+		if strings.HasPrefix(c.FullPath(), "/health") {
+			c.Next()
+			return
+		}
+		group := rateGroup(c)
+		limiter, ok := limiters[group]
+		if !ok {
+			c.Next()
+			return
+		}
+		if ok, wait := limiter.bucket(requestActor(c)).reserve(); !ok {
+			c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded for " + group})
+			return
+		}
+		c.Next()
+	}
+}
+
+// limitGlobalRate caps the requests admitted per second across all clients
+// at GLOBAL_RPS, with bursts of up to GLOBAL_BURST, so that MySQL is
+// protected even when many clients each stay within their own limit. It runs
+// after rateLimitByRoute, so requests refused per client don't use up the
+// shared budget. Over the cap the request is answered 503 with Retry-After.
+func limitGlobalRate(limit rateLimit) gin.HandlerFunc {
+	bucket := newTokenBucket(limit.PerSecond, limit.Burst)
+	return func(c *gin.Context) {
+		if strings.HasPrefix(c.FullPath(), "/health") {
+			c.Next()
+			return
+		}
+		if ok, wait := bucket.reserve(); !ok {
+			c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is at capacity, please retry"})
+			return
+		}
+		c.Next()
+	}
+}
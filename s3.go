@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests to S3 are signed with AWS Signature Version 4 in the query string,
+// the same presigned form handed to clients, so one signer covers the upload
+// URL and the service's own reads and deletes. Credentials come from
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, plus AWS_SESSION_TOKEN for
+// temporary ones.
+
+// s3Client makes the service's own requests to S3
+var s3Client = &http.Client{Timeout: 30 * time.Second}
+
+// errS3ObjectMissing is returned when S3 has no object under a key
+var errS3ObjectMissing = errors.New("s3 object not found")
+
+// s3ObjectURL is the URL of key in S3_BUCKET: virtual-hosted on AWS, or
+// path-style under S3_ENDPOINT
+func s3ObjectURL(key string) *url.URL {
+	if cfg.S3Endpoint != "" {
+		u, _ := url.Parse(cfg.S3Endpoint)
+		u.Path += "/" + cfg.S3Bucket + "/" + key
+		return u
+	}
+	return &url.URL{Scheme: "https", Host: cfg.S3Bucket + ".s3." + cfg.S3Region + ".amazonaws.com", Path: "/" + key}
+}
+
+// s3BucketURL is the URL of S3_BUCKET itself, in the same style as
+// s3ObjectURL
+func s3BucketURL() *url.URL {
+	if cfg.S3Endpoint != "" {
+		u, _ := url.Parse(cfg.S3Endpoint)
+		u.Path += "/" + cfg.S3Bucket
+		return u
+	}
+	return &url.URL{Scheme: "https", Host: cfg.S3Bucket + ".s3." + cfg.S3Region + ".amazonaws.com", Path: "/"}
+}
+
+// presignS3 returns u signed for method, valid for ttl from now. Only the
+// host header is signed, so the client may send any Content-Type.
+func presignS3(method string, u *url.URL, ttl time.Duration, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + cfg.S3Region + "/s3/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    cfg.AWSAccessKeyID + "/" + scope,
+		"X-Amz-Date":          now.Format("20060102T150405Z"),
+		"X-Amz-Expires":       strconv.Itoa(int(ttl.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if cfg.AWSSessionToken != "" {
+		query["X-Amz-Security-Token"] = cfg.AWSSessionToken
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	params := make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = awsURIEncode(k, false) + "=" + awsURIEncode(query[k], false)
+	}
+	canonicalQuery := strings.Join(params, "&")
+	path := awsURIEncode(u.Path, true)
+
+	canonicalRequest := strings.Join([]string{
+		method, path, canonicalQuery, "host:" + u.Host, "", "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", query["X-Amz-Date"], scope, hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + cfg.AWSSecretAccessKey)
+	for _, part := range []string{date, cfg.S3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return u.Scheme + "://" + u.Host + path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// hmacSHA256 is one step of the SigV4 key derivation
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters, as
+// SigV4 requires, leaving slashes alone in paths
+func awsURIEncode(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '.', ch == '_', ch == '~', path && ch == '/':
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// fetchS3Object downloads the object under key. At most limit+1 bytes are
+// read, so the caller can tell an oversized object from one that fits.
+func fetchS3Object(ctx context.Context, key string, limit int) ([]byte, error) {
+	resp, err := s3Request(ctx, http.MethodGet, key)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errS3ObjectMissing
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 GET %s: %s", key, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+}
+
+// deleteS3Object removes the object under key. Deleting a missing object
+// succeeds.
+func deleteS3Object(ctx context.Context, key string) error {
+	resp, err := s3Request(ctx, http.MethodDelete, key)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 DELETE %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// headS3Bucket checks that S3_BUCKET exists and the credentials can reach it
+func headS3Bucket(ctx context.Context) error {
+	resp, err := s3Send(ctx, http.MethodHead, s3BucketURL())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 HEAD %s: %s", cfg.S3Bucket, resp.Status)
+	}
+	return nil
+}
+
+// s3Request sends method for key with a signature valid for a minute
+func s3Request(ctx context.Context, method, key string) (*http.Response, error) {
+	return s3Send(ctx, method, s3ObjectURL(key))
+}
+
+// s3Send sends method for u with a signature valid for a minute
+func s3Send(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, presignS3(method, u, time.Minute, time.Now()), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s3Client.Do(req)
+}
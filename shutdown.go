@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inFlight counts requests currently being handled
+var inFlight atomic.Int64
+
+// trackInFlight keeps inFlight up to date. It runs first in the chain so the
+// count covers the whole handling of each request.
+func trackInFlight() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		c.Next()
+	}
+}
+
+// DebugRequests reports how many requests are in flight
+func debugRequests(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"inFlight": inFlight.Load()})
+}
+
+// shutdown drains srv, logging the in-flight count once a second until every
+// request has finished or timeout expires
+func shutdown(srv *http.Server, timeout time.Duration) {
+	log.Printf("Shutting down with %d requests in flight ...", inFlight.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("Waiting on %d in-flight requests ...", inFlight.Load())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Shutdown closes the listeners straight away, so no new connections are
+	// accepted while the existing ones finish their current request
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown timed out after %v with %d requests still in flight, forcing close: %v",
+			timeout, inFlight.Load(), err)
+		srv.Close()
+		return
+	}
+	log.Printf("Server stopped: all in-flight requests completed")
+}
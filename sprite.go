@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+// spriteCell is where one album's thumbnail sits in a sprite sheet
+type spriteCell struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// spriteMap is sent in the X-Sprite-Map header alongside the sheet
+type spriteMap struct {
+	Albums  map[string]spriteCell `json:"albums"`
+	Missing []int64               `json:"missing"`
+}
+
+// GetThumbnailSprite composes the default thumbnails of the albums in
+// ?ids=1,2,3 into one PNG sprite sheet, laid out in a near-square grid in
+// the order given. The X-Sprite-Map header maps each album ID to its cell;
+// IDs with no album are listed as missing rather than failing the request.
+// At most SPRITE_MAX_IDS albums fit in one sheet.
+func getThumbnailSprite(c *gin.Context) {
+	ids, err := parseSpriteIDs(c.Query("ids"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stop := startTiming(c, timingDB)
+	thumbnails, err := spriteThumbnails(c.Request.Context(), ids)
+	stop()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	stop = startTiming(c, timingImage)
+	sheet, layout, err := renderSprite(ids, thumbnails)
+	stop()
+	if err != nil {
+		log.Printf("Failed to render thumbnail sprite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate sprite"})
+		return
+	}
+
+	header, err := json.Marshal(layout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate sprite"})
+		return
+	}
+	c.Header("X-Sprite-Map", string(header))
+	c.Data(http.StatusOK, "image/png", sheet)
+}
+
+// parseSpriteIDs reads the comma-separated album IDs, dropping repeats
+func parseSpriteIDs(raw string) ([]int64, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, fmt.Errorf("ids is required")
+	}
+	var ids []int64
+	seen := map[int64]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("Invalid album ID %q", part)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) > cfg.SpriteMaxIDs {
+		return nil, fmt.Errorf("At most %d album IDs are allowed per sprite", cfg.SpriteMaxIDs)
+	}
+	return ids, nil
+}
+
+// spriteThumbnails loads the default-size JPEG thumbnail of each album that
+// exists. Stored thumbnails made with other settings are regenerated from
+// the image, as getAlbumThumbnail does.
+func spriteThumbnails(ctx context.Context, ids []int64) (map[int64][]byte, error) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := "SELECT id, thumbnail, thumbnail_spec FROM Albums WHERE id IN (?" +
+		strings.Repeat(", ?", len(ids)-1) + ")"
+	rows, err := replicaQuery(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	thumbnails := map[int64][]byte{}
+	var stale []int64
+	for rows.Next() {
+		var id int64
+		var thumbnail []byte
+		var spec sql.NullString
+		if err := rows.Scan(&id, &thumbnail, &spec); err != nil {
+			return nil, err
+		}
+		if thumbnail != nil && spec.String == thumbnailSpec() {
+			thumbnails[id] = thumbnail
+		} else {
+			stale = append(stale, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range stale {
+		key := thumbnailKey{albumID: id, width: cfg.ThumbnailWidth, quality: cfg.ThumbnailQuality}
+		if thumbnail, ok := thumbnailCache.Get(key); ok {
+			thumbnails[id] = thumbnail
+			continue
+		}
+		var image []byte
+		err := replicaQueryRow(ctx, "SELECT image FROM Albums WHERE id = ?", id).Scan(&image)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		thumbnail, err := makeThumbnail(image, cfg.ThumbnailWidth, cfg.ThumbnailQuality)
+		if err != nil {
+			// Leave the album out of the sheet rather than failing it
+			log.Printf("Failed to create thumbnail for album %d: %v", id, err)
+			continue
+		}
+		thumbnailCache.Add(key, thumbnail)
+		thumbnails[id] = thumbnail
+	}
+	return thumbnails, nil
+}
+
+// renderSprite lays the thumbnails out in ids order, in a grid of
+// ceil(sqrt(n)) square cells THUMBNAIL_WIDTH pixels across, and encodes the
+// sheet as PNG. A thumbnail that doesn't fit its cell, such as one made from
+// a very tall image, is scaled down to fit, so the sheet never grows beyond
+// SPRITE_MAX_IDS cells whatever the albums hold.
+func renderSprite(ids []int64, thumbnails map[int64][]byte) ([]byte, spriteMap, error) {
+	layout := spriteMap{Albums: map[string]spriteCell{}, Missing: []int64{}}
+	var present []int64
+	decoded := map[int64]image.Image{}
+	for _, id := range ids {
+		data, ok := thumbnails[id]
+		if !ok {
+			layout.Missing = append(layout.Missing, id)
+			continue
+		}
+		img, _, err := decodeImage(data)
+		if err != nil {
+			return nil, layout, fmt.Errorf("decode thumbnail for album %d: %w", id, err)
+		}
+		decoded[id] = img
+		present = append(present, id)
+	}
+
+	cell := max(cfg.ThumbnailWidth, 1)
+	cols := max(int(math.Ceil(math.Sqrt(float64(len(present))))), 1)
+	rows := max((len(present)+cols-1)/cols, 1)
+	dst := image.NewNRGBA(image.Rect(0, 0, cols*cell, rows*cell))
+	for i, id := range present {
+		img := decoded[id]
+		b := img.Bounds()
+		at := image.Pt(i%cols*cell, i/cols*cell)
+		w, h := fitCell(b.Dx(), b.Dy(), cell)
+		target := image.Rect(at.X, at.Y, at.X+w, at.Y+h)
+		if w == b.Dx() && h == b.Dy() {
+			draw.Draw(dst, target, img, b.Min, draw.Src)
+		} else {
+			draw.ApproxBiLinear.Scale(dst, target, img, b, draw.Src, nil)
+		}
+		layout.Albums[strconv.FormatInt(id, 10)] = spriteCell{X: at.X, Y: at.Y, Width: w, Height: h}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, layout, fmt.Errorf("encode sprite: %w", err)
+	}
+	return buf.Bytes(), layout, nil
+}
+
+// fitCell is the size a w by h thumbnail is drawn at in a cell pixels square
+// cell: unchanged if it fits, otherwise scaled down keeping its aspect ratio
+func fitCell(w, h, cell int) (int, int) {
+	if w <= cell && h <= cell {
+		return w, h
+	}
+	if w >= h {
+		return cell, max(h*cell/w, 1)
+	}
+	return max(w*cell/h, 1), cell
+}
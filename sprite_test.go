@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestRenderSpriteFitsTallThumbnailsInFixedCells(t *testing.T) {
+	var tall bytes.Buffer
+	if err := png.Encode(&tall, image.NewRGBA(image.Rect(0, 0, 10, 20000))); err != nil {
+		t.Fatal(err)
+	}
+	thumbnails := map[int64][]byte{1: tall.Bytes(), 2: pngImage(t)}
+
+	sheet, layout, err := renderSprite([]int64{1, 2, 3}, thumbnails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(sheet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell := cfg.ThumbnailWidth
+	if config.Width != 2*cell || config.Height != cell {
+		t.Fatalf("sheet is %dx%d, want %dx%d", config.Width, config.Height, 2*cell, cell)
+	}
+	if got := layout.Albums["1"]; got.Height != cell || got.Width != 1 {
+		t.Errorf("tall thumbnail cell = %+v, want it scaled to %d high", got, cell)
+	}
+	if got := layout.Albums["2"]; got != (spriteCell{X: cell, Width: 4, Height: 4}) {
+		t.Errorf("small thumbnail cell = %+v, want it unscaled in the second cell", got)
+	}
+	if len(layout.Missing) != 1 || layout.Missing[0] != 3 {
+		t.Errorf("missing = %v, want [3]", layout.Missing)
+	}
+}
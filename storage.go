@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storageStats summarizes how much image data the Albums table holds
+type storageStats struct {
+	Albums         int64     `json:"albums"`
+	ImageBytes     int64     `json:"imageBytes"`
+	AvgImageBytes  float64   `json:"avgImageBytes"`
+	LargestImageID int64     `json:"largestImageId,omitempty"`
+	LargestBytes   int64     `json:"largestImageBytes"`
+	ComputedAt     time.Time `json:"computedAt"`
+}
+
+// storageCache holds the last computed stats. The mutex is held while
+// computing so concurrent requests wait for one scan instead of each
+// starting their own.
+var storageCache struct {
+	sync.Mutex
+	stats   *storageStats
+	expires time.Time
+}
+
+// computeStorageStats scans every image; it reads the whole table
+func computeStorageStats(ctx context.Context) (*storageStats, error) {
+	stats := &storageStats{ComputedAt: time.Now().UTC()}
+	err := readQueryRow(ctx, `SELECT COUNT(*), COALESCE(SUM(LENGTH(image)), 0), COALESCE(AVG(LENGTH(image)), 0)
+		FROM Albums`).Scan(&stats.Albums, &stats.ImageBytes, &stats.AvgImageBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = readQueryRow(ctx, "SELECT id, LENGTH(image) FROM Albums ORDER BY LENGTH(image) DESC, id LIMIT 1").
+		Scan(&stats.LargestImageID, &stats.LargestBytes)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// DebugStorage reports image storage totals, cached for STORAGE_STATS_TTL
+// because the aggregate reads every blob
+func debugStorage(c *gin.Context) {
+	storageCache.Lock()
+	defer storageCache.Unlock()
+
+	if storageCache.stats == nil || time.Now().After(storageCache.expires) {
+		stats, err := computeStorageStats(c.Request.Context())
+		if err != nil {
+			log.Printf("Failed to compute storage stats: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		storageCache.stats, storageCache.expires = stats, time.Now().Add(cfg.StorageStatsTTL)
+	}
+
+	c.JSON(http.StatusOK, storageCache.stats)
+}
+
+// defaultImageSizeListLimit is how many albums the largest and smallest
+// listings return without a limit
+const defaultImageSizeListLimit = 10
+
+// imageSize is one album in the largest or smallest image listings
+type imageSize struct {
+	ID     int64  `json:"id"`
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// DebugLargestImages lists the albums with the largest images, the best
+// candidates for recompression
+func debugLargestImages(c *gin.Context) {
+	listImagesBySize(c, "DESC")
+}
+
+// DebugSmallestImages lists the albums with the smallest images
+func debugSmallestImages(c *gin.Context) {
+	listImagesBySize(c, "ASC")
+}
+
+// listImagesBySize answers the largest and smallest listings. MySQL takes the
+// length of each image itself, so no image bytes leave the database.
+func listImagesBySize(c *gin.Context, order string) {
+	limit := defaultImageSizeListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > cfg.MaxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(cfg.MaxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	rows, err := readQuery(c.Request.Context(), `SELECT id, artist, title, LENGTH(image) AS bytes FROM Albums
+		ORDER BY bytes `+order+`, id
+		LIMIT ?`, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	albums := []imageSize{}
+	for rows.Next() {
+		var a imageSize
+		if err := rows.Scan(&a.ID, &a.Artist, &a.Title, &a.Bytes); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		albums = append(albums, a)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"albums": albums})
+}
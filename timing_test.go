@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestServerTimingOnResponsesWithoutBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+	}{
+		{"204", func(c *gin.Context) { c.Status(http.StatusNoContent) }},
+		{"304", func(c *gin.Context) { c.Status(http.StatusNotModified) }},
+		{"nothing written", func(c *gin.Context) {}},
+		{"body", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(func(r *gin.Engine) {
+				r.Use(serverTiming())
+				r.GET("/", func(c *gin.Context) {
+					startTiming(c, timingDB)()
+					tt.handler(c)
+				})
+			}, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := w.Header().Get("Server-Timing"); !strings.HasPrefix(got, "db;dur=") {
+				t.Errorf("Server-Timing = %q, want the db phase and total", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFormValueBytes caps each non-file form field
+const maxFormValueBytes = 64 << 10
+
+// Errors from readUploadForm that get their own response
+var (
+	errTooManyParts    = errors.New("too many form parts")
+	errImageTooLarge   = errors.New("image exceeds maximum size")
+	errInvalidMetadata = errors.New("invalid metadata part")
+	errSpoolFailed     = errors.New("failed to spool upload")
+)
+
+// metadataField is the multipart part that may carry the album's fields as
+// one JSON object instead of one part per field
+const metadataField = "metadata"
+
+// albumMetadata is the JSON object accepted in the metadata part
+type albumMetadata struct {
+	Artist          string  `json:"artist"`
+	Title           string  `json:"title"`
+	Year            *int    `json:"year"`
+	TrackCount      *int    `json:"trackCount"`
+	DurationSeconds *int    `json:"durationSeconds"`
+	UPC             *string `json:"upc"`
+	ISRC            *string `json:"isrc"`
+}
+
+// uploadedFile is a file part, read into memory or, when the form was
+// spooled, written to a temp file until load is called
+type uploadedFile struct {
+	filename string
+	data     []byte
+	path     string
+	size     int64
+}
+
+// load returns the file's bytes, reading them back from the temp file for a
+// spooled part
+func (f uploadedFile) load() ([]byte, error) {
+	if f.path == "" {
+		return f.data, nil
+	}
+	return os.ReadFile(f.path)
+}
+
+// uploadForm holds the fields and image of a multipart album upload
+type uploadForm struct {
+	values map[string]string
+	files  map[string]uploadedFile
+}
+
+// readUploadForm streams a multipart body part by part, refusing bodies with
+// more than MAX_FORM_PARTS parts before they are buffered. Only file parts
+// named like the image field are kept; other files are drained and dropped.
+// A JSON metadata part, sent as a plain field or a file, is unpacked into
+// the fields it sets, taking precedence over flat fields of the same name.
+func readUploadForm(r *http.Request) (*uploadForm, error) {
+	return readSpooledUploadForm(r, "")
+}
+
+// readSpooledUploadForm is readUploadForm, except that with a non-empty
+// spoolDir image parts are copied to temp files there instead of being held
+// in memory. The caller must call removeSpooled once done with the form,
+// which readSpooledUploadForm itself does when it fails.
+func readSpooledUploadForm(r *http.Request, spoolDir string) (_ *uploadForm, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	imageFields := make(map[string]bool)
+	for _, name := range fieldAliases("image") {
+		imageFields[name] = true
+	}
+
+	form := &uploadForm{values: make(map[string]string), files: make(map[string]uploadedFile)}
+	defer func() {
+		if err != nil {
+			form.removeSpooled()
+		}
+	}()
+	for parts := 0; ; parts++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			if raw, ok := form.values[metadataField]; ok {
+				if err := form.applyMetadata(raw); err != nil {
+					return nil, err
+				}
+			}
+			return form, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if parts >= cfg.MaxFormParts {
+			part.Close()
+			return nil, errTooManyParts
+		}
+
+		name := part.FormName()
+		if name == metadataField {
+			if ct := part.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+				part.Close()
+				return nil, errInvalidMetadata
+			}
+		}
+		switch {
+		case part.FileName() == "" || name == metadataField:
+			data, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > maxFormValueBytes {
+				return nil, errors.New("form value too large")
+			}
+			if _, seen := form.values[name]; !seen {
+				form.values[name] = string(data)
+			}
+		case imageFields[name] && spoolDir != "":
+			if _, seen := form.files[name]; seen {
+				if _, err := io.Copy(io.Discard, part); err != nil {
+					return nil, err
+				}
+				break
+			}
+			file, err := spoolPart(part, spoolDir)
+			if err != nil {
+				return nil, err
+			}
+			form.files[name] = file
+		case imageFields[name]:
+			data, err := io.ReadAll(io.LimitReader(part, int64(cfg.MaxImageBytes)+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > cfg.MaxImageBytes {
+				return nil, errImageTooLarge
+			}
+			if _, seen := form.files[name]; !seen {
+				form.files[name] = uploadedFile{filename: filepath.Base(part.FileName()), data: data, size: int64(len(data))}
+			}
+		default:
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return nil, err
+			}
+		}
+		part.Close()
+	}
+}
+
+// spoolPart copies an image part to a new temp file in dir, holding no more
+// than io.Copy's buffer in memory. The file is removed again when the part
+// turns out larger than MAX_IMAGE_BYTES or can't be read in full.
+func spoolPart(part *multipart.Part, dir string) (uploadedFile, error) {
+	f, err := os.CreateTemp(dir, "spool-*")
+	if err != nil {
+		return uploadedFile{}, fmt.Errorf("%w: %v", errSpoolFailed, err)
+	}
+	n, err := io.Copy(f, io.LimitReader(part, int64(cfg.MaxImageBytes)+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	// Errors from the file itself, such as a full disk, are the server's;
+	// anything else came from reading the request
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = fmt.Errorf("%w: %v", errSpoolFailed, err)
+	}
+	if err == nil && n > int64(cfg.MaxImageBytes) {
+		err = errImageTooLarge
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return uploadedFile{}, err
+	}
+	return uploadedFile{filename: filepath.Base(part.FileName()), path: f.Name(), size: n}, nil
+}
+
+// removeSpooled deletes the temp files of spooled image parts
+func (f *uploadForm) removeSpooled() {
+	for _, file := range f.files {
+		if file.path != "" {
+			if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed to remove spooled upload %s: %v", file.path, err)
+			}
+		}
+	}
+}
+
+// respondUploadFormError writes the response for a readUploadForm failure
+func respondUploadFormError(c *gin.Context, err error) {
+	switch {
+	case isBodyTooLarge(err):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+	case errors.Is(err, errImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image exceeds maximum size"})
+	case errors.Is(err, errTooManyParts):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many form parts"})
+	case errors.Is(err, errInvalidMetadata):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metadata must be a JSON object of album fields"})
+	case errors.Is(err, errSpoolFailed):
+		log.Printf("Failed to spool upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload"})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
+	}
+}
+
+// applyMetadata stores the fields set in a JSON metadata part as form values
+func (f *uploadForm) applyMetadata(raw string) error {
+	var meta albumMetadata
+	if err := newJSONDecoder(strings.NewReader(raw)).Decode(&meta); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMetadata, err)
+	}
+	set := func(field, v string) {
+		if v != "" {
+			f.values[field] = v
+		}
+	}
+	setInt := func(field string, v *int) {
+		if v != nil {
+			f.values[field] = strconv.Itoa(*v)
+		}
+	}
+	setString := func(field string, v *string) {
+		if v != nil {
+			f.values[field] = *v
+		}
+	}
+	set("artist", meta.Artist)
+	set("title", meta.Title)
+	setInt("year", meta.Year)
+	setInt("trackCount", meta.TrackCount)
+	setInt("durationSeconds", meta.DurationSeconds)
+	setString("upc", meta.UPC)
+	setString("isrc", meta.ISRC)
+	return nil
+}
+
+// value returns the first non-empty value among field's aliases
+func (f *uploadForm) value(field string) string {
+	for _, name := range fieldAliases(field) {
+		if v := f.values[name]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// file returns the first uploaded file among field's aliases
+func (f *uploadForm) file(field string) (uploadedFile, bool) {
+	for _, name := range fieldAliases(field) {
+		if file, ok := f.files[name]; ok {
+			return file, true
+		}
+	}
+	return uploadedFile{}, false
+}
+
+// optionalFormInt parses an optional integer form field, returning nil when
+// it was not sent
+func optionalFormInt(form *uploadForm, field string) (*int, error) {
+	v := strings.TrimSpace(form.value(field))
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, &validationError{field + " must be an integer"}
+	}
+	return &n, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A resumable upload is a file in UPLOAD_DIR named after its ID. The file's
+// size is the upload's offset, so no other state is kept and an upload
+// survives a restart of this instance. Clients on several instances need
+// sticky routing, since the partial file lives on local disk.
+
+// uploadIDPattern matches IDs issued by startUpload; anything else is
+// rejected before it can be used in a path
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// uploadLocks serializes appends and finalization per upload ID. An entry
+// stays in the map while any request holds or waits for it.
+var uploadLocks = struct {
+	sync.Mutex
+	m map[string]*uploadLock
+}{m: make(map[string]*uploadLock)}
+
+// uploadLock is one upload's mutex and the number of requests using it
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+// uploadFinalize is the metadata sent when completing an upload
+type uploadFinalize struct {
+	Artist   string `json:"artist"`
+	Title    string `json:"title"`
+	Year     int    `json:"year"`
+	Filename string `json:"filename"`
+
+	TrackCount      *int `json:"trackCount"`
+	DurationSeconds *int `json:"durationSeconds"`
+}
+
+// initUploads creates the upload and spool directories and starts the
+// janitor that removes uploads idle for longer than UPLOAD_TTL
+func initUploads() {
+	if err := os.MkdirAll(cfg.UploadDir, 0o700); err != nil {
+		log.Fatalf("Failed to create upload directory: %v", err)
+	}
+	if cfg.SpoolUploads {
+		if err := os.MkdirAll(cfg.SpoolDir, 0o700); err != nil {
+			log.Fatalf("Failed to create upload spool directory: %v", err)
+		}
+	}
+	go func() {
+		for range time.Tick(min(cfg.UploadTTL, time.Minute)) {
+			removeExpiredUploads()
+		}
+	}()
+}
+
+// removeExpiredUploads deletes partial uploads not written to within the TTL
+func removeExpiredUploads() {
+	entries, err := os.ReadDir(cfg.UploadDir)
+	if err != nil {
+		log.Printf("Failed to scan upload directory: %v", err)
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !uploadIDPattern.MatchString(e.Name()) {
+			continue
+		}
+		if time.Since(info.ModTime()) > cfg.UploadTTL {
+			lock := lockUpload(e.Name())
+			os.Remove(filepath.Join(cfg.UploadDir, e.Name()))
+			unlockUpload(e.Name(), lock)
+			log.Printf("Removed abandoned upload %s", e.Name())
+		}
+	}
+}
+
+// lockUpload acquires the per-upload mutex for id
+func lockUpload(id string) *uploadLock {
+	uploadLocks.Lock()
+	lock, ok := uploadLocks.m[id]
+	if !ok {
+		lock = &uploadLock{}
+		uploadLocks.m[id] = lock
+	}
+	lock.refs++
+	uploadLocks.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+// unlockUpload releases the mutex from lockUpload, dropping the entry once
+// no other request is using it
+func unlockUpload(id string, lock *uploadLock) {
+	lock.Unlock()
+	uploadLocks.Lock()
+	if lock.refs--; lock.refs == 0 {
+		delete(uploadLocks.m, id)
+	}
+	uploadLocks.Unlock()
+}
+
+// uploadPath resolves the file backing an upload, answering 404 for IDs that
+// are malformed or unknown
+func uploadPath(c *gin.Context) (string, os.FileInfo, bool) {
+	id := c.Param("id")
+	if !uploadIDPattern.MatchString(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return "", nil, false
+	}
+	path := filepath.Join(cfg.UploadDir, id)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return "", nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return "", nil, false
+	}
+	return path, info, true
+}
+
+// StartUpload begins a resumable upload and returns its ID
+func startUpload(c *gin.Context) {
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+
+	f, err := os.OpenFile(filepath.Join(cfg.UploadDir, id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Failed to create upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	f.Close()
+
+	c.Header("Location", "/uploads/"+id)
+	c.JSON(http.StatusCreated, gin.H{"uploadId": id, "offset": 0, "expiresIn": int(cfg.UploadTTL.Seconds())})
+}
+
+// GetUpload reports how many bytes have been received, so a client can
+// resume from there
+func getUpload(c *gin.Context) {
+	_, info, ok := uploadPath(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"uploadId": c.Param("id"), "offset": info.Size()})
+}
+
+// parseContentRange parses "bytes start-end/total", where total may be "*"
+func parseContentRange(header string) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, errors.New("unsupported range unit")
+	}
+	rng, _, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, errors.New("missing total")
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, errors.New("malformed range")
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if start < 0 || end < start {
+		return 0, 0, errors.New("invalid range")
+	}
+	return start, end, nil
+}
+
+// AppendUpload appends the chunk described by Content-Range. Chunks must
+// arrive in order: a start other than the current offset gets 409 with the
+// offset to resume from.
+func appendUpload(c *gin.Context) {
+	path, _, ok := uploadPath(c)
+	if !ok {
+		return
+	}
+	start, end, err := parseContentRange(c.GetHeader("Content-Range"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Content-Range must be bytes start-end/total"})
+		return
+	}
+	if end+1 > int64(cfg.MaxImageBytes) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image exceeds maximum size"})
+		return
+	}
+
+	id := c.Param("id")
+	lock := lockUpload(id)
+	defer unlockUpload(id, lock)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	if start != info.Size() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Chunk does not start at the current offset", "offset": info.Size()})
+		return
+	}
+
+	want := end - start + 1
+	n, err := io.Copy(f, io.LimitReader(c.Request.Body, want))
+	if err == nil && n != want {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// Drop the partial chunk so the client can resend it whole
+		f.Truncate(start)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Incomplete chunk", "offset": start})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"uploadId": id, "offset": start + n})
+}
+
+// FinalizeUpload creates an album from a completed upload and the metadata in
+// the JSON body, then discards the upload
+func finalizeUpload(c *gin.Context) {
+	path, _, ok := uploadPath(c)
+	if !ok {
+		return
+	}
+
+	var req uploadFinalize
+	if !decodeJSONBody(c, &req) {
+		return
+	}
+
+	if rejectDeniedArtist(c, req.Artist) {
+		return
+	}
+
+	id := c.Param("id")
+	lock := lockUpload(id)
+	defer unlockUpload(id, lock)
+
+	image, err := os.ReadFile(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	recordUploadSize(c, len(image))
+
+	in, err := newAlbumInput(req.Artist, req.Title, req.Year, filepath.Base(req.Filename), image)
+	if err == nil {
+		err = in.setDetails(req.TrackCount, req.DurationSeconds)
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	albumID, err := createAlbumRecord(c.Request.Context(), in, requestActor(c))
+	if err != nil {
+		respondCreateError(c, err)
+		return
+	}
+	os.Remove(path)
+
+	c.JSON(http.StatusCreated, gin.H{"AlbumID": albumID})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUploadLockExcludesAndCleansUp(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	// The race needs requests running in parallel, even on one CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	var holders, overlaps atomic.Int32
+	var wg sync.WaitGroup
+	for range 1000 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock := lockUpload(id)
+			if holders.Add(1) > 1 {
+				overlaps.Add(1)
+			}
+			// Give waiters a chance to queue on this lock
+			runtime.Gosched()
+			holders.Add(-1)
+			unlockUpload(id, lock)
+		}()
+	}
+	wg.Wait()
+
+	if n := overlaps.Load(); n > 0 {
+		t.Errorf("the lock was held by two requests at once %d times", n)
+	}
+	uploadLocks.Lock()
+	defer uploadLocks.Unlock()
+	if len(uploadLocks.m) != 0 {
+		t.Errorf("%d lock entries left behind", len(uploadLocks.m))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpsertAlbum stores the multipart album upload under its (artist, title,
+// year), matched the way check-duplicate matches them. A new album answers
+// 201; an existing one has its image and details replaced and answers 200.
+//
+// POST /albums allows duplicates, so the match can't be a plain unique key.
+// Instead one album per identity holds an upsert claim, upsert_canonical =
+// 1, and (artist_norm, title_norm, year, upsert_canonical) is unique: the
+// oldest album at migration time, and since then the first one stored or
+// renamed into the identity. The upsert is a single INSERT ... ON DUPLICATE
+// KEY UPDATE against that key, so concurrent upserts of a new album wait on
+// each other's insert rather than deadlocking, and RowsAffected tells the
+// insert (1) from the update (2). When the album holding the claim is
+// deleted, its duplicates keep none and the next upsert stores a new album.
+func upsertAlbum(c *gin.Context) {
+	in, ok := readAlbumForm(c, false)
+	if !ok {
+		return
+	}
+
+	actor := requestActor(c)
+	var album Album
+	var created bool
+	err := withTx(c.Request.Context(), func(tx *sql.Tx) error {
+		album, created = Album{}, false
+		// id = LAST_INSERT_ID(id) reports the updated row's ID as the insert
+		// ID. artist_norm, title_norm and year are left alone, which is what
+		// tells a match on the claim from a clash with another album's codes.
+		query := `INSERT INTO Albums (artist, title, year, year_text, artist_norm, title_norm, filename, image, image_hash,
+				image_phash, thumbnail, thumbnail_spec, track_count, duration_seconds, upc, isrc, upsert_canonical)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+			ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), artist = VALUES(artist), title = VALUES(title),
+				year_text = VALUES(year_text), filename = VALUES(filename), image = VALUES(image),
+				image_hash = VALUES(image_hash), image_phash = VALUES(image_phash), thumbnail = VALUES(thumbnail),
+				thumbnail_spec = VALUES(thumbnail_spec), track_count = VALUES(track_count),
+				duration_seconds = VALUES(duration_seconds), upc = VALUES(upc), isrc = VALUES(isrc),
+				version = version + 1`
+		result, err := tx.Exec(query, in.artist, in.title, in.year, in.yearText, matchKey(in.artist), matchKey(in.title),
+			in.filename, in.image, imageHash(in.image), in.phash, in.thumbnail, in.thumbnailSpec, in.trackCount,
+			in.durationSeconds, in.upc, in.isrc)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		created = affected == 1
+
+		var artistKey, titleKey string
+		query = "SELECT " + albumSummaryColumns + ", artist_norm, title_norm FROM Albums WHERE id = ?"
+		if err := tx.QueryRow(query, id).Scan(append(album.summaryDest(), &artistKey, &titleKey)...); err != nil {
+			return err
+		}
+		if artistKey != matchKey(in.artist) || titleKey != matchKey(in.title) || album.Year != in.year {
+			// The UPC or ISRC belongs to another album, whose row was just
+			// overwritten; rolling back undoes that
+			return errUpsertCodeTaken
+		}
+
+		if !created {
+			details := in.auditDetails()
+			details["version"] = album.Version
+			return writeAudit(tx, album.ID, auditUpdate, actor, details)
+		}
+		if cfg.MaxAlbumsPerArtist > 0 {
+			// The count includes the album just inserted
+			count, err := countArtistAlbums(tx, in.artist)
+			if err != nil {
+				return err
+			}
+			if count > cfg.MaxAlbumsPerArtist {
+				return errArtistQuota
+			}
+		}
+		return writeAudit(tx, album.ID, auditCreate, actor, in.auditDetails())
+	})
+	if err != nil {
+		if errors.Is(err, errArtistQuota) {
+			respondCreateError(c, err)
+			return
+		}
+		if errors.Is(err, errUpsertCodeTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "UPC or ISRC is already assigned to another album"})
+			return
+		}
+		respondTxError(c, err, "Failed to store album")
+		return
+	}
+
+	c.Header("ETag", strconv.Quote(strconv.Itoa(album.Version)))
+	if created {
+		publishAlbumEvent(albumEvent{Type: auditCreate, AlbumID: album.ID, Album: &album})
+		c.Header("Location", "/albums/"+strconv.FormatInt(album.ID, 10))
+		c.JSON(http.StatusCreated, album)
+		return
+	}
+	thumbnailCache.RemoveFunc(func(k thumbnailKey) bool { return k.albumID == album.ID })
+	convertedCache.RemoveFunc(func(k convertedKey) bool { return k.albumID == album.ID })
+	invalidateCard(album.ID)
+	publishAlbumEvent(albumEvent{Type: auditUpdate, AlbumID: album.ID, Album: &album})
+	c.JSON(http.StatusOK, album)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestUpsertAlbum(t *testing.T) {
+	tests := []struct {
+		name       string
+		affected   int64
+		storedAs   string
+		wantStatus int
+		wantAudit  string
+	}{
+		{"insert", 1, "artist", http.StatusCreated, auditCreate},
+		{"update", 2, "artist", http.StatusOK, auditUpdate},
+		{"clash with another album's code", 2, "someone else", http.StatusConflict, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var audited string
+			fdb := useFakeDB(t, func(query string, args []driver.NamedValue) (fakeResult, error) {
+				switch {
+				case queryIs(query, "INSERT INTO Albums"):
+					return fakeResult{lastID: 42, affected: tt.affected}, nil
+				case queryIs(query, "SELECT "+albumSummaryColumns):
+					return fakeResult{rows: [][]driver.Value{{int64(42), "Artist", "Title", int64(1999), nil,
+						"cover.png", int64(3), nil, nil, nil, nil, tt.storedAs, "title"}}}, nil
+				case queryIs(query, "INSERT INTO audit_log"):
+					audited = args[1].Value.(string)
+				}
+				return fakeResult{affected: 1}, nil
+			})
+
+			w := serve(func(r *gin.Engine) { r.PUT("/albums", upsertAlbum) }, albumUpload(t, http.MethodPut, "/albums",
+				map[string]string{"artist": "Artist", "title": "Title", "year": "1999"}, "cover.png", pngImage(t)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body)
+			}
+			if audited != tt.wantAudit {
+				t.Errorf("audited %q, want %q", audited, tt.wantAudit)
+			}
+			if tt.wantAudit == "" && len(fdb.appliedStatements()) != 0 {
+				t.Errorf("statements applied despite the clash: %q", fdb.appliedStatements())
+			}
+		})
+	}
+}
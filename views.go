@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Views are counted in memory and added to view_count every
+// VIEW_FLUSH_INTERVAL, so a read costs no write and a hot album costs one
+// UPDATE per interval rather than one per view. The tradeoff is that
+// view_count and /albums/popular lag by up to one interval, and views not yet
+// flushed are lost if the process dies without a clean shutdown.
+var pendingViews = struct {
+	sync.Mutex
+	counts map[int64]int64
+}{counts: make(map[int64]int64)}
+
+// recordView counts one read of an album
+func recordView(albumID int64) {
+	pendingViews.Lock()
+	pendingViews.counts[albumID]++
+	pendingViews.Unlock()
+}
+
+// startViewFlusher flushes pending views every interval
+func startViewFlusher(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			flushViews()
+		}
+	}()
+}
+
+// flushViews adds the pending counts to view_count. Counts that fail to
+// write are put back for the next flush.
+func flushViews() {
+	pendingViews.Lock()
+	counts := pendingViews.counts
+	pendingViews.counts = make(map[int64]int64, len(counts))
+	pendingViews.Unlock()
+
+	for albumID, n := range counts {
+		// Keep updated_at, which tracks edits rather than reads
+		_, err := db.Exec("UPDATE Albums SET view_count = view_count + ?, updated_at = updated_at WHERE id = ?",
+			n, albumID)
+		if err != nil {
+			log.Printf("Failed to flush %d views for album %d: %v", n, albumID, err)
+			pendingViews.Lock()
+			pendingViews.counts[albumID] += n
+			pendingViews.Unlock()
+		}
+	}
+}
+
+// PopularAlbums lists albums by descending view count
+func popularAlbums(c *gin.Context) {
+	page, ok := parsePagination(c)
+	if !ok {
+		return
+	}
+
+	total, err := countAlbums(c.Request.Context(), "SELECT COUNT(*) FROM Albums")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	page.Total = total
+	if !capResultRows(c, &page) {
+		return
+	}
+
+	query := "SELECT " + albumSummaryColumns + ", view_count FROM Albums ORDER BY view_count DESC, id LIMIT ? OFFSET ?"
+	rows, err := replicaQuery(c.Request.Context(), query, page.rowLimit(), page.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	albums := []Album{}
+	for rows.Next() {
+		var a Album
+		if err := rows.Scan(append(a.summaryDest(), &a.ViewCount)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		albums = append(albums, a)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	respondPage(c, albums, page)
+}